@@ -0,0 +1,187 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+func hasArchiveMagic(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zipMagic)
+}
+
+func checkArchiveFormat(format string) error {
+	switch format {
+	case "auto", "gzip", "targz", "zip":
+		return nil
+	}
+	return errors.New("Unknown archive format '" + format + "', expected auto, gzip, targz or zip")
+}
+
+func isTar(data []byte) bool {
+	return len(data) >= 262 && bytes.Equal(data[257:262], []byte("ustar"))
+}
+
+// decompressSlots bounds how many archives are unpacked at once when
+// --max-concurrent-decompress is set.
+var decompressSlots chan struct{}
+
+func unpack(data []byte) ([]byte, error) {
+	if decompressSlots != nil && (*archiveFormat != "auto" || hasArchiveMagic(data)) {
+		decompressSlots <- struct{}{}
+		defer func() { <-decompressSlots }()
+	}
+	return unpackArchive(data)
+}
+
+func unpackArchive(data []byte) ([]byte, error) {
+	format := *archiveFormat
+	if format == "auto" {
+		switch {
+		case bytes.HasPrefix(data, zipMagic):
+			format = "zip"
+		case bytes.HasPrefix(data, gzipMagic):
+			format = "gzip"
+		default:
+			return data, nil
+		}
+	}
+	switch format {
+	case "zip":
+		return unzipDatabase(data)
+	case "gzip", "targz":
+		if limit, _ := parseSize(*maxMemoryBuffer); limit > 0 && int64(len(data)) > limit {
+			return spoolGunzip(data, format)
+		}
+		out, err := gunzip(data)
+		if err != nil {
+			return nil, err
+		}
+		if format == "targz" || (*archiveFormat == "auto" && isTar(out)) {
+			return untarDatabase(bytes.NewReader(out))
+		}
+		return out, nil
+	}
+	return nil, checkArchiveFormat(format)
+}
+
+// spoolGunzip decompresses data through a temporary file in --directory
+// rather than a growing buffer, so that a tar archive is never held in
+// memory whole and the database is read back into a buffer of its size.
+func spoolGunzip(data []byte, format string) ([]byte, error) {
+	dir := *directory
+	if *tempDir != "" {
+		dir = *tempDir
+	}
+	f, err := ioutil.TempFile(dir, ".spool-")
+	if err != nil {
+		return nil, err
+	}
+	trackTemp(f.Name())
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+		releaseTemp(f.Name())
+	}()
+	w := bufio.NewWriter(f)
+	if err := gunzipTo(data, w); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Spooled %d decompressed bytes through %s", size, f.Name())
+	head := make([]byte, 262)
+	n, _ := f.ReadAt(head, 0)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if format == "targz" || (*archiveFormat == "auto" && isTar(head[:n])) {
+		return untarDatabase(bufio.NewReader(f))
+	}
+	out := make([]byte, size)
+	if _, err := io.ReadFull(f, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func untarDatabase(r io.Reader) ([]byte, error) {
+	var found []byte
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || path.Ext(hdr.Name) != ".mmdb" {
+			continue
+		}
+		if found != nil {
+			return nil, errors.New("Archive contains more than one .mmdb file")
+		}
+		if found, err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, errors.New("Archive contains no .mmdb file")
+	}
+	return found, nil
+}
+
+func unzipDatabase(data []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var entry *zip.File
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() || path.Ext(f.Name) != ".mmdb" {
+			continue
+		}
+		if entry != nil {
+			return nil, errors.New("Archive contains more than one .mmdb file")
+		}
+		entry = f
+	}
+	if entry == nil {
+		return nil, errors.New("Archive contains no .mmdb file")
+	}
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func archiveBase(name string) string {
+	for _, ext := range []string{".tar.gz", ".tgz", ".gz", ".zip"} {
+		if strings.HasSuffix(name, ext) && len(name) > len(ext) {
+			name = strings.TrimSuffix(name, ext)
+			if path.Ext(name) == "" {
+				name += ".mmdb"
+			}
+			break
+		}
+	}
+	return name
+}
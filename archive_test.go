@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestSpoolUsesTempDir(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	withFlag(t, maxMemoryBuffer, "1")
+	withFlag(t, directory, path.Join(t.TempDir(), "missing"))
+	withFlag(t, tempDir, t.TempDir())
+	got, err := unpack(gzipped(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, db) {
+		t.Fatal("spooled database differs")
+	}
+}
+
+// TestMaxMemoryBufferCrossover tells spooling from in-memory
+// decompression by pointing --directory at a missing directory, where a
+// spool file cannot be created.
+func TestMaxMemoryBufferCrossover(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	gz := gzipped(db)
+	withFlag(t, directory, path.Join(t.TempDir(), "missing"))
+	for _, c := range []struct {
+		limit string
+		spool bool
+	}{
+		{"", false},
+		{strconv.Itoa(len(gz)), false},
+		{strconv.Itoa(len(gz) - 1), true},
+	} {
+		withFlag(t, maxMemoryBuffer, c.limit)
+		got, err := unpack(gz)
+		if spooled := err != nil; spooled != c.spool {
+			t.Fatalf("--max-memory-buffer %q on %d bytes: spooled=%v, want %v (%v)", c.limit, len(gz), spooled, c.spool, err)
+		}
+		if err == nil && !bytes.Equal(got, db) {
+			t.Fatalf("--max-memory-buffer %q: wrong data", c.limit)
+		}
+	}
+	withFlag(t, directory, t.TempDir())
+	got, err := unpack(gz)
+	if err != nil || !bytes.Equal(got, db) {
+		t.Fatalf("spooled unpack failed: %v", err)
+	}
+}
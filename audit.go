@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditTransport logs the scheme and host of every request, including
+// those made to follow redirects, and refuses hosts not in --allowed-hosts.
+type auditTransport struct {
+	base *http.Transport
+}
+
+func hostAllowed(host string) bool {
+	allowed := splitList(*allowedHosts)
+	if len(allowed) == 0 {
+		return true
+	}
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	for _, a := range allowed {
+		if a == host || a == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hostAllowed(req.URL.Host) {
+		log.Printf("Refusing request to %s://%s: not in --allowed-hosts", req.URL.Scheme, req.URL.Host)
+		return nil, errors.New("Host " + req.URL.Host + " is not in --allowed-hosts")
+	}
+	log.Printf("Requesting %s://%s", req.URL.Scheme, req.URL.Host)
+	if *proxyAuth != "" && req.URL.Scheme == "http" && t.base.Proxy != nil {
+		// Requests forwarded by an http proxy carry the header themselves;
+		// https ones get it on the CONNECT through ProxyConnectHeader.
+		if u, err := t.base.Proxy(req); err == nil && u != nil && u.User == nil {
+			req = req.Clone(req.Context())
+			req.Header.Set("Proxy-Authorization", *proxyAuth)
+		}
+	}
+	res, err := t.base.RoundTrip(req)
+	if err == nil && res.TLS != nil {
+		if err = checkCertExpiry(req.URL.Host, res.TLS); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+	}
+	return res, err
+}
+
+var (
+	certWarned     = make(map[string]bool)
+	certWarnedLock sync.Mutex
+)
+
+// checkCertExpiry looks at the earliest expiry in the verified chain,
+// warning once per host within --cert-warn-days and failing every
+// request within --require-cert-days.
+func checkCertExpiry(host string, cs *tls.ConnectionState) error {
+	if (*certWarnDays <= 0 && *requireCertDays <= 0) || len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	var expires time.Time
+	for _, c := range cs.VerifiedChains[0] {
+		if expires.IsZero() || c.NotAfter.Before(expires) {
+			expires = c.NotAfter
+		}
+	}
+	days := int(time.Until(expires).Hours() / 24)
+	if *requireCertDays > 0 && days < *requireCertDays {
+		return errors.New("Certificate for " + host + " expires in " + strconv.Itoa(days) +
+			" days, less than --require-cert-days " + strconv.Itoa(*requireCertDays))
+	}
+	if *certWarnDays > 0 && days < *certWarnDays {
+		certWarnedLock.Lock()
+		defer certWarnedLock.Unlock()
+		if !certWarned[host] {
+			certWarned[host] = true
+			log.Printf("WARNING: certificate for %s expires in %d days, at %s", host, days, expires.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// redactAuth keeps only the scheme of an authorization value.
+func redactAuth(v string) string {
+	if i := strings.IndexByte(v, ' '); i > 0 {
+		return v[:i] + " [redacted]"
+	}
+	return "[redacted]"
+}
+
+func (t *auditTransport) CloseIdleConnections() {
+	t.base.CloseIdleConnections()
+}
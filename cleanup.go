@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	tempFiles     = make(map[string]bool)
+	tempFilesLock sync.Mutex
+)
+
+// runCtx is cancelled on SIGINT or SIGTERM, aborting requests in flight.
+var runCtx, cancelRun = context.WithCancel(context.Background())
+
+func trackTemp(fn string) {
+	tempFilesLock.Lock()
+	defer tempFilesLock.Unlock()
+	tempFiles[fn] = true
+}
+
+func releaseTemp(fn string) {
+	tempFilesLock.Lock()
+	defer tempFilesLock.Unlock()
+	delete(tempFiles, fn)
+}
+
+// handleSignals cancels runCtx and removes the temporary files of in-flight
+// products on SIGINT or SIGTERM, then exits with 128 plus the signal number.
+func handleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-ch
+		cancelRun()
+		tempFilesLock.Lock()
+		for fn := range tempFiles {
+			if err := os.Remove(fn); err == nil {
+				log.Printf("Removed %s", fn)
+			}
+		}
+		log.Printf("Exiting on %s", sig)
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
+		}
+		os.Exit(code)
+	}()
+}
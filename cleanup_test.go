@@ -0,0 +1,81 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSignalMidDownload runs itself in a child process that is sent
+// SIGTERM while a download is in flight and a temporary file is open.
+func TestSignalMidDownload(t *testing.T) {
+	if dir := os.Getenv("GEOIPUPDATE_SIGNAL_DIR"); dir != "" {
+		signalChild(dir, os.Getenv("GEOIPUPDATE_SIGNAL_SOURCE"))
+		return
+	}
+	started := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == filenamePath {
+			w.Write([]byte("GeoLite2-City.mmdb"))
+			return
+		}
+		w.Write(gzipMagic)
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSignalMidDownload$")
+	cmd.Env = append(os.Environ(),
+		"GEOIPUPDATE_SIGNAL_DIR="+dir,
+		"GEOIPUPDATE_SIGNAL_SOURCE="+strings.TrimPrefix(srv.URL, "http://"))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("download never started")
+	}
+	if tmps, _ := filepath.Glob(path.Join(dir, "*.tmp")); len(tmps) != 1 {
+		cmd.Process.Kill()
+		t.Fatalf("found temporary files %q before the signal, want one", tmps)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := cmd.Wait()
+	if ee, ok := err.(*exec.ExitError); !ok || ee.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Fatalf("child exited with %v, want status %d", err, 128+int(syscall.SIGTERM))
+	}
+	if tmps, _ := filepath.Glob(path.Join(dir, "*.tmp")); len(tmps) > 0 {
+		t.Fatalf("temporary files left: %q", tmps)
+	}
+}
+
+func signalChild(dir string, source string) {
+	*directory = dir
+	*sourceHost = source
+	*protocol = "http"
+	*updateProto = "v2"
+	*accountId = "42"
+	proto = V2Protocol{}
+	handleSignals()
+	tmp := tempPath(path.Join(dir, "GeoLite2-Country.mmdb"))
+	ioutil.WriteFile(tmp, []byte("partial"), 0644)
+	getProduct("GeoLite2-City")
+	// The download only ends when the signal cancels it; the handler then
+	// exits before this does.
+	time.Sleep(10 * time.Second)
+	os.Exit(0)
+}
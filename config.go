@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"regexp"
+)
+
+var (
+	numericProductId = regexp.MustCompile(`^[0-9]+$`)
+	editionProductId = regexp.MustCompile(`^[A-Za-z0-9]+(-[A-Za-z0-9]+)+$`)
+)
+
+func usingDefault(name string) bool {
+	f := flag.Lookup(name)
+	return f != nil && f.Value.String() == f.DefValue
+}
+
+// legacyDefaults reports whether the legacy protocol is used with the
+// default product IDs or source, which belong to MaxMind's retired GeoLite
+// Legacy service, and --allow-legacy was not given.
+func legacyDefaults() bool {
+	if *allowLegacy || *mirrorUrl != "" || *updateProto != "legacy" {
+		return false
+	}
+	return usingDefault("productids") || usingDefault("source")
+}
+
+// warnLegacyDefaults nudges configurations still relying on the GeoLite
+// Legacy defaults towards GeoLite2 editions.
+func warnLegacyDefaults() {
+	if legacyDefaults() {
+		log.Printf("WARNING: the default legacy product IDs and protocol are for MaxMind's retired GeoLite Legacy service; configure GeoLite2 editions with --update-protocol v2 --productids GeoLite2-City,..., or pass --allow-legacy if your source still serves them")
+	}
+}
+
+// checkSizeMap checks an edition=size list such as --min-size.
+func checkSizeMap(s string) error {
+	sizes, err := parseEditionMap(s)
+	if err != nil {
+		return err
+	}
+	for edition, size := range sizes {
+		if _, err := parseSize(size); err != nil {
+			return errors.New("Invalid size for " + edition + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// productIdValid reports whether p has the form the configured protocol
+// wants. With --protocol-fallback, the other protocol's form is accepted
+// too.
+func productIdValid(p string, want *regexp.Regexp) bool {
+	if want.MatchString(p) {
+		return true
+	}
+	return *protocolFallback && (numericProductId.MatchString(p) || editionProductId.MatchString(p))
+}
+
+func configProblems() []string {
+	var problems []string
+	products := splitList(*productIds)
+	if len(products) == 0 {
+		problems = append(problems, "No products given in --productids")
+	}
+	if err := checkArchiveFormat(*archiveFormat); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if (*signatureUrl == "") != (*publicKey == "") {
+		problems = append(problems, "--signature-url and --public-key must be given together")
+	}
+	if *retryFailed && (*stateFile == "" || *interval > 0) {
+		problems = append(problems, "--retry-failed requires --state-file and cannot be used with --interval")
+	}
+	if *minBuildAdvance != "" {
+		if _, err := parseAge(*minBuildAdvance); err != nil {
+			problems = append(problems, "Invalid --min-build-advance '"+*minBuildAdvance+"': "+err.Error())
+		}
+	}
+	if *maxMemoryBuffer != "" {
+		if _, err := parseSize(*maxMemoryBuffer); err != nil {
+			problems = append(problems, "Invalid --max-memory-buffer '"+*maxMemoryBuffer+"': "+err.Error())
+		}
+	}
+	if err := checkSizeMap(*minSize); err != nil {
+		problems = append(problems, "Invalid --min-size '"+*minSize+"': "+err.Error())
+	}
+	if err := checkSizeMap(*minResponseSize); err != nil {
+		problems = append(problems, "Invalid --min-response-size '"+*minResponseSize+"': "+err.Error())
+	}
+	if _, err := verifyAddresses(); err != nil {
+		problems = append(problems, err.Error()+" in --verify-address")
+	}
+	if _, err := parseProductHooks(); err != nil {
+		problems = append(problems, "Invalid --product-hook: "+err.Error())
+	}
+	if _, err := parseExpectations(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	switch *cycleReportFormat {
+	case "", "json", "text":
+	default:
+		problems = append(problems, "Unknown --cycle-report '"+*cycleReportFormat+"', expected json or text")
+	}
+	if err := checkRetryJitter(*retryJitter); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if *dirSync != "required" && *dirSync != "best-effort" {
+		problems = append(problems, "Unknown --dir-sync '"+*dirSync+"', expected required or best-effort")
+	}
+	if *licenseKeyStdin && flagGiven("licensekey") {
+		problems = append(problems, "--licensekey-stdin and --licensekey cannot both be given")
+	}
+	if *verifyConsistency && (*mirrorUrl == "" || !credentialsGiven(*updateProto)) {
+		problems = append(problems, "--verify-mirror-consistency requires --mirror-url and the --source credentials")
+	}
+	if *statusFormat != "json" && *statusFormat != "yaml" {
+		problems = append(problems, "Unknown --status-format '"+*statusFormat+"', expected json or yaml")
+	}
+	switch *orderBy {
+	case "config":
+	case "size-asc", "size-desc":
+		if *stateFile == "" {
+			problems = append(problems, "--order-by "+*orderBy+" requires --state-file")
+		}
+	default:
+		problems = append(problems, "Unknown --order-by '"+*orderBy+"', expected size-asc, size-desc or config")
+	}
+	switch *onProductGone {
+	case "skip", "fail", "remove":
+	default:
+		problems = append(problems, "Unknown --on-product-gone '"+*onProductGone+"', expected skip, fail or remove")
+	}
+	if *onProductGone == "remove" && *mirrorUrl == "" && *updateProto == "legacy" {
+		problems = append(problems, "--on-product-gone remove needs --update-protocol v2 or --mirror-url; legacy product IDs cannot be matched to installed files")
+	}
+	if _, err := newProtocol(*updateProto); err != nil {
+		return append(problems, err.Error())
+	}
+	if *mirrorUrl != "" {
+		return problems
+	}
+	if *licenseKey == "" {
+		problems = append(problems, "--licensekey is required")
+	}
+	switch *updateProto {
+	case "v2":
+		if *accountId == "" {
+			problems = append(problems, "--accountid is required for --update-protocol v2")
+		}
+		for _, p := range products {
+			if !productIdValid(p, editionProductId) {
+				problems = append(problems, "Product '"+p+"' is not an edition ID such as GeoLite2-City, which --update-protocol v2 requires")
+			}
+		}
+	case "legacy":
+		if *refuseLegacy && legacyDefaults() {
+			problems = append(problems, "The legacy defaults are for MaxMind's retired GeoLite Legacy service; configure GeoLite2 editions with --update-protocol v2, or pass --allow-legacy")
+		}
+		if *userId == "" {
+			problems = append(problems, "--userid is required for --update-protocol legacy")
+		}
+		for _, p := range products {
+			if !productIdValid(p, numericProductId) {
+				problems = append(problems, "Product '"+p+"' is not a numeric product ID, which --update-protocol legacy requires")
+			}
+		}
+	}
+	return problems
+}
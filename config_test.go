@@ -0,0 +1,172 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+// withFlag sets a string flag for the duration of a test.
+func withFlag(t *testing.T, p *string, v string) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// withGivenFlags swaps in a fresh flag set, bound to the credential
+// variables, so that flags marked as given with flag.Set do not leak into
+// other tests.
+func withGivenFlags(t *testing.T) {
+	old := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	t.Cleanup(func() { flag.CommandLine = old })
+	withFlag(t, licenseKey, *licenseKey)
+	withFlag(t, userId, *userId)
+	flag.StringVar(licenseKey, "licensekey", *licenseKey, "")
+	flag.StringVar(userId, "userid", *userId, "")
+}
+
+func hasProblem(problems []string, substr string) bool {
+	for _, p := range problems {
+		if strings.Contains(p, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestConfigProblemsVerifyAddress(t *testing.T) {
+	withFlag(t, verifyAddress, "1.2.3.4,bogus")
+	if !hasProblem(configProblems(), "'bogus' in --verify-address") {
+		t.Fatalf("invalid --verify-address not reported: %q", configProblems())
+	}
+	withFlag(t, verifyAddress, "1.2.3.4,::1")
+	if hasProblem(configProblems(), "--verify-address") {
+		t.Fatalf("valid --verify-address reported: %q", configProblems())
+	}
+}
+
+func withBool(t *testing.T, p *bool, v bool) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func TestConfigProblemsProtocolFallbackIds(t *testing.T) {
+	withFlag(t, updateProto, "v2")
+	withFlag(t, accountId, "42")
+	withFlag(t, productIds, "GeoLite2-City,506,not_an_id")
+	if !hasProblem(configProblems(), "'506'") {
+		t.Errorf("numeric ID accepted under v2 without --protocol-fallback")
+	}
+	withBool(t, protocolFallback, true)
+	problems := configProblems()
+	if hasProblem(problems, "'506'") || hasProblem(problems, "'GeoLite2-City'") {
+		t.Errorf("valid IDs rejected with --protocol-fallback: %q", problems)
+	}
+	if !hasProblem(problems, "'not_an_id'") {
+		t.Errorf("malformed ID accepted with --protocol-fallback: %q", problems)
+	}
+}
+
+func TestLegacyDefaults(t *testing.T) {
+	withFlag(t, updateProto, "legacy")
+	if !legacyDefaults() {
+		t.Fatal("default invocation not detected as using the legacy defaults")
+	}
+	if hasProblem(configProblems(), "legacy defaults") {
+		t.Fatal("legacy defaults refused without --refuse-legacy")
+	}
+	withBool(t, refuseLegacy, true)
+	if !hasProblem(configProblems(), "legacy defaults") {
+		t.Fatal("legacy defaults accepted with --refuse-legacy")
+	}
+	withBool(t, allowLegacy, true)
+	if legacyDefaults() || hasProblem(configProblems(), "legacy defaults") {
+		t.Fatal("--allow-legacy did not accept the legacy defaults")
+	}
+}
+
+func TestConfigProblemsRemoveGoneLegacy(t *testing.T) {
+	withFlag(t, onProductGone, "remove")
+	withFlag(t, updateProto, "legacy")
+	if !hasProblem(configProblems(), "--on-product-gone remove") {
+		t.Fatal("--on-product-gone remove accepted with the legacy protocol")
+	}
+	withFlag(t, updateProto, "v2")
+	withFlag(t, accountId, "42")
+	withFlag(t, productIds, "GeoLite2-City")
+	if problems := configProblems(); hasProblem(problems, "--on-product-gone") {
+		t.Fatalf("--on-product-gone remove refused with v2: %q", problems)
+	}
+}
+
+func TestConfigProblemsEmptyProducts(t *testing.T) {
+	for _, ids := range []string{"", " ", " , ,\t", ","} {
+		withFlag(t, productIds, ids)
+		if !hasProblem(configProblems(), "No products given in --productids") {
+			t.Errorf("--productids %q not reported as empty", ids)
+		}
+	}
+}
+
+func TestConfigProblemsSizeMaps(t *testing.T) {
+	for _, c := range []struct {
+		flag    *string
+		name    string
+		value   string
+		invalid bool
+	}{
+		{minSize, "--min-size", "GeoLite2-City", true},
+		{minSize, "--min-size", "GeoLite2-City=lots", true},
+		{minSize, "--min-size", "GeoLite2-City=10m,GeoLite2-ASN=512k", false},
+		{minResponseSize, "--min-response-size", "GeoLite2-City", true},
+		{minResponseSize, "--min-response-size", "GeoLite2-City=1G", false},
+	} {
+		withFlag(t, c.flag, c.value)
+		if got := hasProblem(configProblems(), "Invalid "+c.name); got != c.invalid {
+			t.Errorf("%s %q: reported=%v, want %v", c.name, c.value, got, c.invalid)
+		}
+	}
+}
+
+func TestParseSizeSuffixCase(t *testing.T) {
+	for s, want := range map[string]int64{"10": 10, "2k": 2 << 10, "2K": 2 << 10, "3m": 3 << 20, "3M": 3 << 20, "1g": 1 << 30, "1G": 1 << 30} {
+		if n, err := parseSize(s); err != nil || n != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", s, n, err, want)
+		}
+	}
+}
+
+func TestConfigProblemsMirrorConsistencyCredentials(t *testing.T) {
+	const problem = "--verify-mirror-consistency requires"
+	withGivenFlags(t)
+	withBool(t, verifyConsistency, true)
+	withFlag(t, mirrorUrl, "https://mirror.example/{edition}.mmdb.gz")
+	withFlag(t, updateProto, "v2")
+	withFlag(t, productIds, "GeoLite2-City")
+	if !hasProblem(configProblems(), problem) {
+		t.Fatal("placeholder license key accepted")
+	}
+	flag.Set("licensekey", "secret")
+	if !hasProblem(configProblems(), problem) {
+		t.Fatal("v2 accepted without --accountid")
+	}
+	withFlag(t, accountId, "42")
+	if problems := configProblems(); hasProblem(problems, problem) {
+		t.Fatalf("v2 credentials refused: %q", problems)
+	}
+	withFlag(t, updateProto, "legacy")
+	withFlag(t, productIds, "533")
+	if !hasProblem(configProblems(), problem) {
+		t.Fatal("legacy accepted with the placeholder --userid")
+	}
+	flag.Set("userid", "1234")
+	if problems := configProblems(); hasProblem(problems, problem) {
+		t.Fatalf("legacy credentials refused: %q", problems)
+	}
+	withFlag(t, mirrorUrl, "")
+	if !hasProblem(configProblems(), problem) {
+		t.Fatal("accepted without --mirror-url")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+// mirrorDigest downloads the copy of productId served by --mirror-url and
+// returns the MD5 of the database in it.
+func mirrorDigest(productId string) (string, error) {
+	u, err := mirrorProductUrl(productId)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := doWithRetries(req, productId)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if !isSuccess(res.StatusCode) {
+		return "", errors.New("Status " + res.Status + " received from mirror")
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if data, err = unpack(data); err != nil {
+		return "", err
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// primaryAgrees offers digest to --source as the installed copy of
+// productId; the copies agree if the source has no update for it.
+func primaryAgrees(productId string, digest string) (bool, error) {
+	req, err := proto.UpdateRequest(productId, digest)
+	if err != nil {
+		return false, err
+	}
+	if *updateProto == "v2" {
+		req.Method = "HEAD"
+	}
+	res, data, err := doClassifiedRequest(req, productId)
+	if err != nil {
+		return false, err
+	}
+	if req.Method == "HEAD" {
+		switch {
+		case res.StatusCode == http.StatusNotModified:
+			return true, nil
+		case isSuccess(res.StatusCode):
+			return false, nil
+		}
+		return false, errors.New("Status " + res.Status + " received")
+	}
+	pr, err := proto.ParseResponse(res, data)
+	if err != nil {
+		return false, err
+	}
+	return pr.NoUpdate, nil
+}
+
+// checkMirrorConsistency warns about every product whose --mirror-url copy
+// is not the one --source currently serves.
+func checkMirrorConsistency(products []string) {
+	if *updateProto == "legacy" {
+		if err := ensureClientIp(); err != nil {
+			log.Printf("Cannot check mirror consistency: %v", err)
+			return
+		}
+	}
+	for _, p := range products {
+		digest, err := mirrorDigest(p)
+		if err != nil {
+			log.Printf("Cannot check mirror consistency of %s: %v", p, err)
+			continue
+		}
+		agrees, err := primaryAgrees(p, digest)
+		switch {
+		case err != nil:
+			log.Printf("Cannot check mirror consistency of %s: %v", p, err)
+		case agrees:
+			log.Printf("Mirror copy of %s matches %s (MD5 %s)", p, urlHost(), digest)
+		default:
+			log.Printf("WARNING: mirror copy of %s (MD5 %s) differs from the database %s serves", p, digest, urlHost())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const directIOAlign = 4096
+const directIOChunk = 1024 * 1024
+
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlign)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlign - 1))
+	if off != 0 {
+		off = directIOAlign - off
+	}
+	return buf[off : off+size]
+}
+
+func writeFileDirect(fn string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_DIRECT, perm)
+	if err != nil {
+		return err
+	}
+	aligned := len(data) - len(data)%directIOAlign
+	buf := alignedBuffer(directIOChunk)
+	for off := 0; off < aligned; off += directIOChunk {
+		n := aligned - off
+		if n > directIOChunk {
+			n = directIOChunk
+		}
+		copy(buf, data[off:off+n])
+		if _, err := f.Write(buf[:n]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if aligned == len(data) {
+		return nil
+	}
+	f, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data[aligned:]); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func writeFileDirect(fn string, data []byte, perm os.FileMode) error {
+	return errors.New("O_DIRECT is not supported on this platform")
+}
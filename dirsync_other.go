@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+func syncDir(dir string) (supported bool, err error) {
+	return false, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+)
+
+func dryRunFilename(productId string) (string, error) {
+	if *mirrorUrl != "" {
+		u, err := mirrorProductUrl(productId)
+		if err != nil {
+			return "", err
+		}
+		return mirrorFilename(u), nil
+	}
+	return resolveFilename(proto, productId)
+}
+
+func reportDryRun(w io.Writer, products []string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRODUCT\tFILENAME\tTARGET\tACTION")
+	for _, p := range products {
+		filename, err := dryRunFilename(p)
+		if err != nil {
+			fmt.Fprintf(tw, "%s\t-\t-\terror: %v\n", p, err)
+			continue
+		}
+		filePath := path.Join(*directory, filename)
+		if *throughSymlink {
+			if target, ok := linkTarget(filePath); ok {
+				filePath = target
+			}
+		}
+		action := "install"
+		if _, err := os.Stat(filePath); err == nil {
+			action = "replace if changed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p, filename, filePath, action)
+	}
+	return tw.Flush()
+}
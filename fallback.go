@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func lastGoodPath(filePath string) string {
+	return filePath + ".last-good"
+}
+
+func replaceFile(filePath string, data []byte) error {
+	tmp := tempPath(filePath)
+	defer releaseTemp(tmp)
+	if err := writeFile(tmp, data, databaseMode()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := moveFile(tmp, filePath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func saveLastGood(filePath string, data []byte) {
+	if err := replaceFile(lastGoodPath(filePath), data); err != nil {
+		log.Printf("Cannot save last known good copy of %s: %v", filePath, err)
+	}
+}
+
+func validDatabase(data []byte) error {
+	if _, err := metadataFromBytes(data); err != nil {
+		return err
+	}
+	return verifyDatabase(data)
+}
+
+func fallbackToLastGood(filename string, filePath string) {
+	if data, err := ioutil.ReadFile(filePath); err == nil && validDatabase(data) == nil {
+		return
+	}
+	good := lastGoodPath(filePath)
+	data, err := ioutil.ReadFile(good)
+	if err != nil {
+		log.Printf("No last known good copy of %s to fall back to: %v", filename, err)
+		return
+	}
+	if err := validDatabase(data); err != nil {
+		log.Printf("Last known good copy %s is no longer valid: %v", good, err)
+		return
+	}
+	if err := replaceFile(filePath, data); err != nil {
+		log.Printf("Cannot fall back to last known good copy of %s: %v", filename, err)
+		return
+	}
+	log.Printf("Fell back to last known good copy of %s from %s", filename, good)
+}
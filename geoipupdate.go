@@ -1,164 +1,716 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"flag"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	sourceHost  = flag.String("source", "updates.maxmind.com", "source address for updates")
-	protocol    = flag.String("protocol", "https", "protocol for updates (http or https)")
-	directory   = flag.String("directory", "/usr/local/var/GeoIP", "directory to update")
-	userId      = flag.String("userid", "999999", "MaxMind user ID")
-	licenseKey  = flag.String("licensekey", "000000000000", "MaxMind licence Key")
-	dolinks     = flag.Bool("links", true, "Create legacy symlinks")
-	productIds  = flag.String("productids", "506,533,517", "Comma delimited product IDs")
-	randomDelay = flag.String("randomdelay", "", "Wait for a random time period up to this amount")
+	sourceHost         = flag.String("source", "updates.maxmind.com", "source address for updates (or unix:///path/to/socket)")
+	allowedHosts       = flag.String("allowed-hosts", "", "Comma delimited hosts (host or host:port) that may be contacted; any other request, including a redirect, is refused")
+	requireCertDays    = flag.Int("require-cert-days", 0, "Fail requests if the server certificate chain expires within this many days")
+	certWarnDays       = flag.Int("cert-warn-days", 0, "Warn if the server certificate chain expires within this many days")
+	proxyAuth          = flag.String("proxy-authorization", "", "Raw Proxy-Authorization value (e.g. \"Bearer <token>\") for proxies whose URL has no credentials")
+	hostHeader         = flag.String("host-header", "localhost", "Host header to send when the source is a unix socket")
+	clientIpUrl        = flag.String("client-ip-url", "", "URL returning the client IP (default /app/update_getipaddr on the source)")
+	mirrorUrl          = flag.String("mirror-url", "", "Fetch products from this URL template instead ({edition} is replaced by the product ID)")
+	protocol           = flag.String("protocol", "https", "protocol for updates (http or https)")
+	directory          = flag.String("directory", "/usr/local/var/GeoIP", "directory to update")
+	userId             = flag.String("userid", "999999", "MaxMind user ID")
+	accountId          = flag.String("accountid", "", "MaxMind account ID (for --update-protocol v2)")
+	onProductGone      = flag.String("on-product-gone", "fail", "When the server reports a product as not found: skip, fail or remove its installed database (not with the legacy protocol)")
+	verifyConsistency  = flag.Bool("verify-mirror-consistency", false, "Before updating, warn about each product whose --mirror-url copy differs from the one --source serves")
+	preflightCheck     = flag.Bool("preflight", false, "Before updating, check the credentials with one small authenticated request and exit if they are rejected")
+	protocolFallback   = flag.Bool("protocol-fallback", false, "On an authentication failure, retry each product once with the other update protocol")
+	updateProto        = flag.String("update-protocol", "legacy", "Update protocol (legacy or v2)")
+	md5Header          = flag.String("md5-header", "X-Database-MD5", "Response header carrying the database MD5 for --update-protocol v2")
+	licenseKeyStdin    = flag.Bool("licensekey-stdin", false, "Read the license key from the first line of stdin instead of --licensekey")
+	allowLegacy        = flag.Bool("allow-legacy", false, "Use the legacy protocol defaults without a warning")
+	refuseLegacy       = flag.Bool("refuse-legacy", false, "Treat the legacy protocol defaults as a configuration error unless --allow-legacy is given")
+	licenseKey         = flag.String("licensekey", "000000000000", "MaxMind licence Key")
+	relativeLinks      = flag.Bool("relative-symlinks", false, "Make legacy symlinks relative to --directory instead of absolute")
+	dolinks            = flag.Bool("links", true, "Create legacy symlinks")
+	noLinksOnFailure   = flag.Bool("no-symlink-on-failure", false, "Leave the legacy symlinks untouched if any product failed")
+	forceLinks         = flag.Bool("force-links", false, "Create legacy symlinks even in secure mode")
+	secure             = flag.Bool("secure", false, "Install databases readable only by owner and group, without legacy symlinks")
+	orderBy            = flag.String("order-by", "config", "Order products by last installed size: size-asc, size-desc or config (--productids order)")
+	productIds         = flag.String("productids", "506,533,517", "Comma delimited product IDs")
+	retries            = flag.Int("retries", 0, "Retry a request this many times after a network error or 5xx response")
+	retryBase          = flag.Duration("retry-base", time.Second, "Base of the exponential backoff between retries")
+	retryJitter        = flag.String("retry-jitter", "full", "Jitter applied to the retry backoff: full, equal or none (see README)")
+	waitNetwork        = flag.Duration("wait-for-network", 0, "Wait up to this long for the source host to accept connections before starting")
+	once               = flag.Bool("once", false, "Run a single update and exit, even if --interval is given")
+	randomDelay        = flag.String("randomdelay", "", "Wait for a random time period up to this amount")
+	noDelay            = flag.Bool("no-delay", false, "Ignore --randomdelay for this run")
+	forceDelay         = flag.Bool("force-delay", false, "Honour --randomdelay even when stdout is a terminal")
+	productDelay       = flag.Duration("inter-product-delay", 0, "Wait this long between starting each product")
+	interval           = flag.Duration("interval", 0, "Run as a daemon, updating at this interval")
+	maxFailedCycles    = flag.Int("max-consecutive-failures", 0, "In daemon mode, exit with status 1 after this many consecutive cycles with failures (0 to keep running)")
+	ignoreCacheControl = flag.Bool("ignore-cache-control", false, "In daemon mode, re-check every product each cycle even if Cache-Control max-age says it is still fresh")
+	cycleReportFormat  = flag.String("cycle-report", "", "In daemon mode, print a one-line summary of each cycle to stdout: json or text")
+	quietUnchanged     = flag.Bool("quiet-unchanged", false, "Do not log products that had no update")
+	keepIdle           = flag.Bool("keep-idle-connections", false, "In daemon mode, keep idle HTTP connections open between cycles")
+	jitter             = flag.String("interval-jitter", "", "Randomize each daemon interval by up to this percentage (e.g. 10%)")
+	minBuildAdvance    = flag.String("min-build-advance", "", "Only install a new build if it is at least this much newer (e.g. 3d) than the installed one")
+	noDowngrade        = flag.Bool("no-downgrade", false, "Refuse to install a MaxMind DB older than the installed one")
+	force              = flag.Bool("force", false, "Install even if a safety check would refuse")
+	archiveFormat      = flag.String("archive-format", "auto", "Format of downloaded archives: auto, gzip, targz or zip")
+	tolerantGzip       = flag.Bool("tolerant-gzip", false, "Ignore trailing bytes after a complete gzip stream")
+	throughSymlink     = flag.Bool("install-through-symlink", false, "If a database is a symlink, replace its target rather than the link")
+	dirSync            = flag.String("dir-sync", "required", "Whether a failed fsync of the database directory after install is an error (required) or only logged (best-effort)")
+	tempDir            = flag.String("temp-dir", "", "Write downloads here before moving them into --directory (default --directory itself)")
+	requireSameFs      = flag.Bool("require-same-fs", false, "Refuse to start if --temp-dir is not on the same filesystem as --directory")
+	directIO           = flag.Bool("direct-io", false, "Write databases with O_DIRECT to bypass the page cache where supported")
+	readableUser       = flag.String("verify-readable-by", "", "After installing, warn if this user cannot read the database")
+	minFreeInodes      = flag.Uint64("min-free-inodes", 0, "Refuse to write a database unless the directory has this many free inodes")
+	fallbackGood       = flag.Bool("fallback-to-last-good", false, "Keep a <file>.last-good copy of each verified database and reinstall it if a download fails verification and the installed file is invalid")
+	keepFailed         = flag.Bool("keep-failed", false, "Keep a download that fails verification as <file>.failed")
+	postSweep          = flag.Bool("post-sweep", false, "After each run, re-verify every database in --directory and fail the run if any is invalid")
+	verifyAddress      = flag.String("verify-address", "1.1.1.1,2001:4860:4860::8888", "Comma delimited addresses to look up when verifying a downloaded MaxMind DB")
+	verifyExpect       = newListFlag("verify-expect", "Fail the install unless this address resolves to this value, e.g. 1.1.1.1=AU or 1.1.1.1=AS13335 (repeatable)")
+	concurrency        = flag.Int("concurrency", 1, "Number of products to update at once")
+	maxDecompress      = flag.Int("max-concurrent-decompress", 0, "Number of downloads to decompress at once, separately from --concurrency (0 for no limit)")
+	maxPerHost         = flag.Int("max-concurrent-per-host", 0, "Number of products to update at once from any one host (0 for no limit)")
+	signatureUrl       = flag.String("signature-url", "", "URL template ({edition} is replaced) of a detached signature over each database")
+	publicKey          = flag.String("public-key", "", "PEM file with the ed25519 or RSA public key for --signature-url")
+	maxMemoryBuffer    = flag.String("max-memory-buffer", "", "Decompress gzip downloads larger than this (e.g. 20M) through a temporary file instead of memory")
+	minResponseSize    = flag.String("min-response-size", "", "Comma delimited edition=size floors (e.g. GeoLite2-City=10M) for the Content-Length of a download")
+	productHooks       = newListFlag("product-hook", "Run a command when this product changes, e.g. GeoLite2-ASN=/usr/local/bin/reload-asn; the product ID and path are appended (repeatable)")
+	hookRequired       = flag.Bool("hook-required", false, "Count a product as failed if its --product-hook fails")
+	minSize            = flag.String("min-size", "", "Comma delimited product=size minimum database sizes (e.g. GeoLite2-City=10M)")
+	maxPerRun          = flag.Int("max-products-per-run", 0, "Update at most this many products per run, rotating through the list in daemon mode (0 for no limit)")
+	allowedTypes       = flag.String("allowed-types", "", "Comma delimited MaxMind DB types permitted in the directory (default any)")
+	breakerThreshold   = flag.Int("circuit-breaker", 0, "Fail the remaining products after this many consecutive failures (0 to disable)")
+	progressFd         = flag.Int("progress-fd", -1, "Write JSON progress events, one per line, to this file descriptor")
+	exitBitmap         = flag.Bool("exit-bitmap", false, "Encode which products failed in the exit code (see README)")
+
+	metricsTextfile = flag.String("metrics-textfile", "", "Write OpenMetrics text to this file after each run")
+	junitReport     = flag.String("junit-report", "", "Write a JUnit XML report with one testcase per product after each run")
+	stateFile       = flag.String("state-file", "", "Record daemon progress in this file so a restart resumes the current cycle")
+	statusFormat    = flag.String("status-format", "json", "Encoding of --status-file: json or yaml")
+	statusFile      = flag.String("status-file", "", "Write a JSON summary of each product's outcome, source host and protocol after each run")
+	changedMarker   = flag.String("changed-marker", "", "Write this file (e.g. <directory>/.changed) whenever at least one product changed")
+	retryFailed     = flag.Bool("retry-failed", false, "Update only the products that failed in the previous run, as recorded in --state-file")
+	historyFile     = flag.String("history-file", "", "Append a record of each installed database to this file")
+
+	logFile     = flag.String("log-file", "", "Write log output to this file instead of stderr")
+	maxLogBytes = flag.Int64("max-log-bytes", 0, "Cap --log-file at this size, discarding the oldest output (0 for no limit)")
+
+	reportAges     = flag.Bool("report-build-ages", false, "Report the build date and age of each installed MaxMind DB and exit")
+	reportStaleDbs = flag.Bool("report-stale", false, "Check installed editions against --max-age and exit non-zero if any is stale or missing")
+	maxAge         = flag.String("max-age", "", "Comma delimited edition=age thresholds for --report-stale (e.g. GeoLite2-City=7d)")
+	listenAddr     = flag.String("listen", ":8080", "Address to listen on in serve mode")
+	manifestFile   = flag.String("export-manifest", "", "Write a JSON manifest of the installed databases with their digests to this file (- for stdout) and exit")
+	dryRun         = flag.Bool("dry-run", false, "Report the filename and target path each product would be installed to and exit")
+	linksDryRun    = flag.Bool("links-dry-run", false, "Report which legacy symlinks would be created or left alone and exit")
+	since          = flag.String("since", "", "Report databases changed within this period (e.g. 7d) from --history-file and exit")
+	verifyOnly     = flag.Bool("verify", false, "Verify each installed .mmdb file and exit non-zero if any is invalid")
+	reportFormat   = flag.String("format", "text", "Output format for --verify: text or json")
 )
 
 var clientIp string
 
+var client = &http.Client{}
+
+const unixPrefix = "unix://"
+
+func setupClient() {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if strings.HasPrefix(*sourceHost, unixPrefix) {
+		socket := strings.TrimPrefix(*sourceHost, unixPrefix)
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	}
+	if *proxyAuth != "" {
+		tr.ProxyConnectHeader = http.Header{"Proxy-Authorization": {*proxyAuth}}
+		log.Printf("Sending Proxy-Authorization %s to proxies without credentials in their URL", redactAuth(*proxyAuth))
+	}
+	client.Transport = &auditTransport{base: tr}
+}
+
+func urlHost() string {
+	if strings.HasPrefix(*sourceHost, unixPrefix) {
+		return *hostHeader
+	}
+	return *sourceHost
+}
+
 func isSuccess(statusCode int) bool {
 	return statusCode >= 200 && statusCode <= 209
 }
 
-func download(location string, query map[string]string) (*http.Response, []byte, error) {
+func sourceUrl(location string, query map[string]string) string {
 	var vals url.Values = url.Values{}
 	for k, v := range query {
 		vals.Set(k, v)
 	}
 	u := url.URL{
-		Host:   *sourceHost,
+		Host:   urlHost(),
 		Scheme: *protocol,
 		Path:   location,
 	}
 	u.RawQuery = vals.Encode()
-	res, err := http.Get(u.String())
+	return u.String()
+}
+
+func download(location string, query map[string]string) (*http.Response, []byte, error) {
+	return fetch(sourceUrl(location, query), "")
+}
+
+func fetch(u string, productId string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doRequest(req, productId)
+}
+
+var (
+	gzipMagic     = []byte("\x1f\x8b")
+	noUpdatesBody = []byte("No new updates available")
+)
+
+const classifyLimit = 4096
+
+func readClassified(res *http.Response, productId string) ([]byte, error) {
+	br := bufio.NewReader(res.Body)
+	prefix, err := br.Peek(len(noUpdatesBody))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isSuccess(res.StatusCode) && !bytes.HasPrefix(prefix, noUpdatesBody) {
+		if err := checkResponseSize(productId, res); err != nil {
+			return nil, err
+		}
+	}
+	if hasArchiveMagic(prefix) {
+		return ioutil.ReadAll(newProgressReader(br, productId, res.ContentLength))
+	}
+	return ioutil.ReadAll(io.LimitReader(br, classifyLimit))
+}
+
+func doClassifiedRequest(req *http.Request, productId string) (*http.Response, []byte, error) {
+	return doRequestWith(req, productId, func(res *http.Response) ([]byte, error) {
+		return readClassified(res, productId)
+	})
+}
+
+func doRequest(req *http.Request, productId string) (*http.Response, []byte, error) {
+	return doRequestWith(req, productId, func(res *http.Response) ([]byte, error) {
+		return ioutil.ReadAll(res.Body)
+	})
+}
+
+func statusCode(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
+
+func doRequestWith(req *http.Request, productId string, read func(*http.Response) ([]byte, error)) (*http.Response, []byte, error) {
+	res, err := doWithRetries(req, productId)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Download from %s://%s ERROR %s", req.URL.Scheme, req.URL.Host, err)
+		return nil, nil, err
 	}
 	defer res.Body.Close()
-	data, err := ioutil.ReadAll(res.Body)
+	data, err := read(res)
 	if err != nil {
-		log.Printf("Download from %s ERROR %s", u.String(), err)
+		log.Printf("Download from %s ERROR %s", req.URL.String(), err)
 		return res, nil, err
 	}
 	return res, data, nil
 }
 
-func md5File(fn string) string {
+const emptyDigest = "00000000000000000000000000000000"
+
+func md5File(fn string) (string, error) {
 	if data, err := ioutil.ReadFile(fn); err != nil {
-		return "00000000000000000000000000000000"
+		return emptyDigest, err
 	} else {
 		hasher := md5.New()
 		hasher.Write(data)
-		return hex.EncodeToString(hasher.Sum(nil))
+		return hex.EncodeToString(hasher.Sum(nil)), nil
 	}
 }
 
-func updateSecure(oldDigest string, productId string, challenge string) ([]byte, error) {
-	response, data, err := download("/app/update_secure", map[string]string{
-		"db_md5":        oldDigest,
-		"challenge_md5": challenge,
-		"user_id":       *userId,
-		"edition_id":    productId,
-	})
-	if !isSuccess(response.StatusCode) {
-		return nil, errors.New("Status " + response.Status + " received")
+var (
+	errNotAdvanced = errors.New("Build has not advanced enough")
+	errSameContent = errors.New("Identical to the installed file")
+)
+
+// sameContent reports whether filePath already holds data, so that a
+// download that changed nothing writes nothing.
+func sameContent(filePath string, data []byte) bool {
+	fi, err := os.Stat(filePath)
+	if err != nil || fi.Size() != int64(len(data)) {
+		return false
 	}
-	return data, err
+	old, err := ioutil.ReadFile(filePath)
+	return err == nil && bytes.Equal(old, data)
 }
 
-func getProduct(productId string) error {
-	if response, data, err := download("/app/update_getfilename", map[string]string{"product_id": productId}); err != nil {
+func checkBuildAdvance(filename string, filePath string, data []byte) error {
+	minAdvance, err := parseAge(*minBuildAdvance)
+	if err != nil {
 		return err
-	} else {
-		if !isSuccess(response.StatusCode) {
-			return errors.New("Status " + response.Status + " received")
+	}
+	newMd, err := metadataFromBytes(data)
+	if err != nil {
+		return nil
+	}
+	oldMd, err := metadataFromFile(filePath)
+	if err != nil {
+		return nil
+	}
+	advance := time.Duration(int64(newMd.BuildEpoch)-int64(oldMd.BuildEpoch)) * time.Second
+	if advance < minAdvance {
+		log.Printf("Not installing %s: build advanced by %s, less than --min-build-advance %s", filename, advance, *minBuildAdvance)
+		return errNotAdvanced
+	}
+	return nil
+}
+
+func checkDowngrade(filePath string, data []byte) error {
+	newMd, err := metadataFromBytes(data)
+	if err != nil {
+		return nil
+	}
+	oldMd, err := metadataFromFile(filePath)
+	if err != nil {
+		return nil
+	}
+	if newMd.BuildEpoch < oldMd.BuildEpoch {
+		return errors.New("Downloaded build " + time.Unix(int64(newMd.BuildEpoch), 0).UTC().String() +
+			" is older than installed build " + time.Unix(int64(oldMd.BuildEpoch), 0).UTC().String())
+	}
+	return nil
+}
+
+// checkGzipTrailer compares the CRC32 and ISIZE fields ending consumed,
+// the part of the stream read so far, with those of the member written.
+func checkGzipTrailer(consumed []byte, sum uint32, n int64) error {
+	if len(consumed) < 8 {
+		return errors.New("Truncated gzip trailer")
+	}
+	trailer := consumed[len(consumed)-8:]
+	if crc := binary.LittleEndian.Uint32(trailer[:4]); crc != sum {
+		return errors.New("Gzip trailer CRC32 does not match decompressed data")
+	}
+	if size := binary.LittleEndian.Uint32(trailer[4:]); size != uint32(n) {
+		return errors.New("Gzip trailer size " + strconv.FormatUint(uint64(size), 10) +
+			" does not match " + strconv.FormatInt(n, 10) + " decompressed bytes")
+	}
+	return nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	if err := gunzipTo(data, &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func gunzipTo(data []byte, w io.Writer) error {
+	buf := bytes.NewBuffer(data)
+	gzr, err := gzip.NewReader(buf)
+	if err != nil {
+		return err
+	}
+	for {
+		gzr.Multistream(false)
+		h := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(w, h), gzr)
+		if err == nil {
+			err = checkGzipTrailer(data[:len(data)-buf.Len()], h.Sum32(), n)
+		}
+		if err != nil {
+			return err
+		}
+		if buf.Len() == 0 || *tolerantGzip && !bytes.HasPrefix(buf.Bytes(), gzipMagic) {
+			break
+		}
+		if err := gzr.Reset(buf); err != nil {
+			return err
 		}
-		filename := path.Base(string(data[:]))
-		log.Printf("Attempting to update %s", filename)
-		filePath := path.Join(*directory, filename)
-		oldDigest := md5File(filePath)
+	}
+	if err := gzr.Close(); err != nil {
+		return err
+	}
+	if buf.Len() > 0 {
+		log.Printf("Ignoring %d trailing bytes after gzip stream", buf.Len())
+	}
+	return nil
+}
 
-		hasher := md5.New()
-		hasher.Write([]byte(*licenseKey))
-		hasher.Write([]byte(clientIp))
-		challenge := hex.EncodeToString(hasher.Sum(nil))
-
-		attempts := 0
-		var uncompressed []byte
-		for {
-			if data, err := updateSecure(oldDigest, productId, challenge); err != nil {
-				return err
-			} else {
-				if bytes.HasPrefix(data, []byte("No new updates available")) {
-					if len(uncompressed) > 0 {
-						log.Printf("Update retrieved for %s", filename)
-						break
-					} else {
-						log.Printf("No new updates available for %s", filename)
-						return nil
-					}
-				}
-				if !bytes.HasPrefix(data, []byte("\x1f\x8b")) {
-					return errors.New("Not a gzip file")
-				}
-				attempts++
-				if attempts > 5 {
-					return errors.New("Too many attempts at downloading file")
-				}
-				buf := bytes.NewBuffer(data)
-				if gzr, err := gzip.NewReader(buf); err != nil {
-					return err
-				} else {
-					defer gzr.Close()
-					var err error
-					if uncompressed, err = ioutil.ReadAll(gzr); err != nil {
-						return err
-					}
-				}
-				hasher := md5.New()
-				hasher.Write(uncompressed)
-				oldDigest = hex.EncodeToString(hasher.Sum(nil))
-			}
+func writeFile(fn string, data []byte, perm os.FileMode) error {
+	if *directIO {
+		if err := writeFileDirect(fn, data, perm); err == nil {
+			return nil
+		} else {
+			log.Printf("Direct I/O write of %s failed, falling back to buffered write: %v", fn, err)
+		}
+	}
+	return ioutil.WriteFile(fn, data, perm)
+}
+
+func checkFreeInodes(dir string) error {
+	free, supported, err := freeInodes(dir)
+	if err != nil {
+		return err
+	}
+	if supported && free < *minFreeInodes {
+		return errors.New("Out of inodes: " + dir + " has " + strconv.FormatUint(free, 10) +
+			" free, need at least " + strconv.FormatUint(*minFreeInodes, 10))
+	}
+	return nil
+}
+
+func databaseMode() os.FileMode {
+	if *secure {
+		return 0640
+	}
+	return 0644
+}
+
+func tempSuffix() string {
+	return "." + strconv.Itoa(os.Getpid()) + "." + strconv.FormatInt(randInt64(1<<32), 16) + ".tmp"
+}
+
+func tempPath(filePath string) string {
+	fn := filePath + tempSuffix()
+	if *tempDir != "" {
+		fn = filepath.Join(*tempDir, filepath.Base(filePath)+tempSuffix())
+	}
+	trackTemp(fn)
+	return fn
+}
+
+func discardFailed(tmpFilePath string, filePath string) {
+	if *keepFailed {
+		failedPath := filePath + ".failed"
+		if err := moveFile(tmpFilePath, failedPath); err != nil {
+			log.Printf("Cannot keep failed download as %s: %v", failedPath, err)
+		} else {
+			log.Printf("Kept failed download as %s", failedPath)
+			return
 		}
+	}
+	os.Remove(tmpFilePath)
+}
 
-		tmpFilePath := filePath + ".tmp"
-		if err := ioutil.WriteFile(tmpFilePath, uncompressed, 0644); err != nil {
+func linkTarget(filePath string) (string, bool) {
+	fi, err := os.Lstat(filePath)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return filePath, false
+	}
+	if target, err := filepath.EvalSymlinks(filePath); err == nil {
+		return target, true
+	}
+	dest, err := os.Readlink(filePath)
+	if err != nil {
+		return filePath, false
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(filepath.Dir(filePath), dest)
+	}
+	return dest, true
+}
+
+func installFile(productId string, filename string, filePath string, data []byte) error {
+	if err := checkMinSize(productId, data); err != nil {
+		log.Printf("Refusing to install %s: %v", filename, err)
+		return err
+	}
+	if *throughSymlink {
+		if target, ok := linkTarget(filePath); ok {
+			log.Printf("Installing %s through symlink to %s", filename, target)
+			filePath = target
+		}
+	}
+	if !*force && sameContent(filePath, data) {
+		log.Printf("Not installing %s: identical to the installed file", filename)
+		return errSameContent
+	}
+	if *noDowngrade && !*force {
+		if err := checkDowngrade(filePath, data); err != nil {
+			log.Printf("Refusing to install %s: %v", filename, err)
 			return err
 		}
-		if err := os.Rename(tmpFilePath, filePath); err != nil {
+	}
+
+	if *minBuildAdvance != "" && !*force {
+		if err := checkBuildAdvance(filename, filePath, data); err != nil {
 			return err
 		}
 	}
 
+	if *minFreeInodes > 0 {
+		if err := checkFreeInodes(path.Dir(filePath)); err != nil {
+			return err
+		}
+	}
+
+	tmpFilePath := tempPath(filePath)
+	defer releaseTemp(tmpFilePath)
+	if err := writeFile(tmpFilePath, data, databaseMode()); err != nil {
+		os.Remove(tmpFilePath)
+		return err
+	}
+	if err := checkSignature(productId, data); err != nil {
+		log.Printf("Signature verification of %s failed: %v", filename, err)
+		discardFailed(tmpFilePath, filePath)
+		return err
+	}
+	if err := verifyDatabase(data); err != nil {
+		log.Printf("Verification of %s failed: %v", filename, err)
+		discardFailed(tmpFilePath, filePath)
+		if *fallbackGood {
+			fallbackToLastGood(filename, filePath)
+		}
+		return err
+	}
+	oldMd, _ := metadataFromFile(filePath)
+	if err := moveFile(tmpFilePath, filePath); err != nil {
+		os.Remove(tmpFilePath)
+		return err
+	}
+	if err := syncParentDir(filePath); err != nil {
+		return err
+	}
+	if *fallbackGood && validDatabase(data) == nil {
+		saveLastGood(filePath, data)
+	}
+	recordSize(productId, int64(len(data)))
+	if *readableUser != "" {
+		if ok, err := readableBy(filePath, *readableUser); err != nil {
+			log.Printf("Cannot check whether %s can read %s: %v", *readableUser, filename, err)
+		} else if !ok {
+			log.Printf("WARNING: %s is not readable by %s", filePath, *readableUser)
+		}
+	}
+	newMd, _ := metadataFromBytes(data)
+	if err := recordHistory(filePath, oldMd, newMd); err != nil {
+		log.Printf("Cannot record history for %s: %v", filename, err)
+	}
+	if err := runProductHook(productId, filePath); err != nil {
+		log.Printf("%v", err)
+		hookErrorsLock.Lock()
+		hookErrors[productId] = err
+		hookErrorsLock.Unlock()
+	}
 	return nil
 }
 
+// syncParentDir makes the rename of filePath durable. With --dir-sync
+// best-effort a filesystem that cannot fsync directories is tolerated.
+func syncParentDir(filePath string) error {
+	dir := filepath.Dir(filePath)
+	supported, err := syncDir(dir)
+	if !supported || err == nil {
+		return nil
+	}
+	if *dirSync == "best-effort" {
+		log.Printf("Ignoring failed fsync of directory %s: %v", dir, err)
+		return nil
+	}
+	return errors.New("Cannot fsync directory " + dir + ": " + err.Error())
+}
+
+func resolveFilename(proto Protocol, productId string) (string, error) {
+	req, err := proto.FilenameRequest(productId)
+	if err != nil {
+		return "", err
+	}
+	response, data, err := doRequest(req, productId)
+	recordStatus(productId, statusCode(response))
+	if err != nil {
+		return "", err
+	}
+	pr, err := proto.ParseResponse(response, data)
+	if err != nil {
+		return "", err
+	}
+	return pr.Filename, nil
+}
+
+var (
+	usedProtocols     = make(map[string]string)
+	usedProtocolsLock sync.Mutex
+)
+
+// takeUsedProtocol returns and forgets the protocol getProduct last fell
+// back to for productId, or "" if it did not fall back.
+func takeUsedProtocol(productId string) string {
+	usedProtocolsLock.Lock()
+	defer usedProtocolsLock.Unlock()
+	name := usedProtocols[productId]
+	delete(usedProtocols, productId)
+	return name
+}
+
+func getProduct(productId string) (bool, error) {
+	changed, err := getProductWith(proto, productId)
+	if _, ok := err.(*authError); ok && *protocolFallback {
+		if name, other := fallbackProtocol(); other != nil {
+			if name == "legacy" {
+				if err := ensureClientIp(); err != nil {
+					return false, err
+				}
+			}
+			log.Printf("Authentication failed for %s with the %s protocol, falling back to %s: %v", productId, *updateProto, name, err)
+			usedProtocolsLock.Lock()
+			usedProtocols[productId] = name
+			usedProtocolsLock.Unlock()
+			return getProductWith(other, productId)
+		}
+	}
+	return changed, err
+}
+
+func getProductWith(proto Protocol, productId string) (bool, error) {
+	source := *protocol + "://" + urlHost()
+	if filename, ok := freshFilename(productId, source); ok {
+		logOutcome(productId, filename, false)
+		return false, nil
+	}
+	filename, err := resolveFilename(proto, productId)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Attempting to update %s", filename)
+	filePath := path.Join(*directory, filename)
+	oldDigest, err := md5File(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Cannot read existing %s, forcing download: %v", filePath, err)
+	}
+	installed := err == nil
+
+	// Each request offers the digest of what we hold: the installed file
+	// at first, then the latest download. "No update" for the installed
+	// file means it is current; for a download, it confirms that the
+	// download is the current database. A response that carries its own
+	// digest needs no confirmation. Any other download means the previous
+	// one was incomplete or superseded, so it is replaced.
+	attempts := 0
+	downloaded := false
+	var uncompressed []byte
+	var last *http.Response
+	for {
+		req, err := proto.UpdateRequest(productId, oldDigest)
+		if err != nil {
+			return false, err
+		}
+		response, data, err := doClassifiedRequest(req, productId)
+		recordStatus(productId, statusCode(response))
+		if err != nil {
+			return false, err
+		}
+		pr, err := proto.ParseResponse(response, data)
+		if err != nil {
+			return false, err
+		}
+		last = response
+		if pr.NoUpdate {
+			if downloaded {
+				break
+			}
+			if !installed {
+				return false, errors.New("Server reports no update for " + filename + ", which is not installed")
+			}
+			recordFreshness(productId, filePath, source, last)
+			logOutcome(productId, filename, false)
+			return false, nil
+		}
+		attempts++
+		if attempts > 5 {
+			return false, errors.New("Too many attempts at downloading file")
+		}
+		if uncompressed, err = unpack(pr.Data); err != nil {
+			return false, err
+		}
+		downloaded = true
+		hasher := md5.New()
+		hasher.Write(uncompressed)
+		oldDigest = hex.EncodeToString(hasher.Sum(nil))
+		if pr.Digest != "" {
+			if pr.Digest != oldDigest {
+				return false, errors.New("Digest mismatch: expected " + pr.Digest + ", got " + oldDigest)
+			}
+			break
+		}
+	}
+
+	if err := installFile(productId, filename, filePath, uncompressed); err == errNotAdvanced || err == errSameContent {
+		recordFreshness(productId, filePath, source, last)
+		logOutcome(productId, filename, false)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	recordFreshness(productId, filePath, source, last)
+	logOutcome(productId, filename, true)
+	return true, nil
+}
+
+var clientIpLock sync.Mutex
+
+func ensureClientIp() error {
+	clientIpLock.Lock()
+	defer clientIpLock.Unlock()
+	if clientIp != "" {
+		return nil
+	}
+	return getClientIp()
+}
+
 func getClientIp() error {
-	if response, data, err := download("/app/update_getipaddr", map[string]string{}); err != nil {
-		return err
+	var response *http.Response
+	var data []byte
+	var err error
+	if *clientIpUrl != "" {
+		response, data, err = fetch(*clientIpUrl, "")
 	} else {
-		if !isSuccess(response.StatusCode) {
-			return errors.New("Status " + response.Status + " received")
-		}
-		clientIp = string(data[:])
+		response, data, err = download("/app/update_getipaddr", map[string]string{})
+	}
+	if err != nil {
+		return err
+	}
+	if !isSuccess(response.StatusCode) {
+		return errors.New("Status " + response.Status + " received")
 	}
+	ip := strings.TrimSpace(string(data[:]))
+	if net.ParseIP(ip) == nil {
+		return errors.New("Invalid client IP '" + ip + "' received")
+	}
+	clientIp = ip
 	return nil
 }
 
@@ -172,12 +724,354 @@ func randInt64(max int64) int64 {
 	return data % max
 }
 
+// isTerminal treats any character device other than the null device,
+// which cron jobs often send their output to, as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(fi, null)
+}
+
+// delaySkipReason says why --randomdelay should not be honoured, if it
+// should not: --no-delay always wins, and an interactive run, one whose
+// stdout is a terminal, skips the delay unless --force-delay is given.
+func delaySkipReason(terminal bool) string {
+	switch {
+	case *noDelay:
+		return "--no-delay given"
+	case !*forceDelay && terminal:
+		return "stdout is a terminal (use --force-delay to wait anyway)"
+	}
+	return ""
+}
+
+func parsePercent(s string) (float64, error) {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if pct < 0 || pct > 100 {
+		return 0, errors.New("Percentage must be between 0 and 100")
+	}
+	return pct, nil
+}
+
+func jitterDuration(d time.Duration, pct float64) time.Duration {
+	spread := int64(float64(d.Nanoseconds()) * pct / 100)
+	if spread <= 0 {
+		return d
+	}
+	return d - time.Duration(spread) + time.Duration(randInt64(2*spread+1))
+}
+
+type productResult struct {
+	ProductId string
+	Changed   bool
+	Err       error
+	Duration  time.Duration
+	Host      string
+	Protocol  string
+	Retries   int
+	HookErr   error
+}
+
+func logOutcome(productId string, filename string, changed bool) {
+	if changed {
+		log.Printf("Update retrieved for %s product=%s outcome=updated", filename, productId)
+	} else if !*quietUnchanged {
+		log.Printf("No new updates available for %s product=%s outcome=unchanged", filename, productId)
+	}
+}
+
+func logSummary(results []productResult) {
+	updated, unchanged, failed := 0, 0, 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			failed++
+		case r.Changed:
+			updated++
+		default:
+			unchanged++
+		}
+	}
+	log.Printf("Summary updated=%d unchanged=%d failed=%d", updated, unchanged, failed)
+}
+
+func anyFailed(results []productResult) bool {
+	for _, r := range results {
+		if r.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+const exitBitmapBase = 64
+
+// exitCode is 0 if every product succeeded, and otherwise exitBitmapBase
+// plus a mask of the products that failed: bits 0-4 for the first five in
+// --productids order and bit 5 for any later one. Other statuses (1, 2, 4,
+// 128 plus a signal) stay below or above that range.
+func exitCode(results []productResult) int {
+	code := 0
+	position := make(map[string]int)
+	for i, p := range splitList(*productIds) {
+		position[p] = i
+	}
+	for _, r := range results {
+		if r.Err == nil && !(*hookRequired && r.HookErr != nil) {
+			continue
+		}
+		if i := position[r.ProductId]; i < 5 {
+			code |= 1 << uint(i)
+		} else {
+			code |= 1 << 5
+		}
+	}
+	if code == 0 {
+		return 0
+	}
+	return exitBitmapBase | code
+}
+
+// oneShotStatus is the exit status of a one-shot run. A run-level error
+// that no product accounts for, such as a failed --post-sweep, is status 1
+// even with --exit-bitmap.
+func oneShotStatus(results []productResult, err error) int {
+	if *exitBitmap {
+		if code := exitCode(results); code != 0 {
+			return code
+		}
+		if err != nil {
+			return 1
+		}
+		return 0
+	}
+	if err != nil || *hookRequired && hookFailed(results) {
+		return 1
+	}
+	return 0
+}
+
+func update(products []string) ([]productResult, error) {
+	if *mirrorUrl != "" {
+		log.Printf("Updating geoip database at %s from mirror %s", *directory, *mirrorUrl)
+	} else {
+		log.Printf("Updating geoip database at %s from %s via %s", *directory, *sourceHost, *protocol)
+	}
+	results := make([]productResult, len(products))
+	get := getProduct
+	if *mirrorUrl != "" {
+		get = getMirrorProduct
+	} else if *updateProto == "v2" {
+		clientIp = ""
+	} else if err := getClientIp(); err != nil {
+		log.Printf("Can't get client IP: %v", err)
+		for i, p := range products {
+			results[i] = productResult{ProductId: p, Host: productHost(p), Protocol: productProtocol(), Err: err}
+			recordOutcome(p, results[i].outcome())
+		}
+		logSummary(results)
+		return results, err
+	}
+	results = runProducts(products, get)
+	if reason := linksDisabled(); reason != "" {
+		if *dolinks {
+			log.Printf("Not making legacy links: %s", reason)
+		}
+	} else if *noLinksOnFailure && anyFailed(results) {
+		log.Printf("Not making legacy links because a product failed (--no-symlink-on-failure)")
+	} else {
+		log.Printf("Making legacy links in %s", *directory)
+		makeLinks()
+	}
+	logSummary(results)
+	log.Printf("Done\n")
+	return results, nil
+}
+
+func touchChanged(fn string, results []productResult) error {
+	for _, r := range results {
+		if r.Changed {
+			return ioutil.WriteFile(fn, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0644)
+		}
+	}
+	return nil
+}
+
+func cycle(resume bool) ([]productResult, error) {
+	started := time.Now()
+	products := startCycle(splitList(*productIds), resume)
+	products = orderProducts(products)
+	if len(products) == 0 && *retryFailed {
+		log.Printf("No products failed in the previous run, nothing to retry")
+		return nil, nil
+	}
+	results, err := update(products)
+	if *postSweep {
+		if serr := sweep(*directory); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if *junitReport != "" {
+		if err := writeJUnitReport(*junitReport, results, started); err != nil {
+			log.Printf("Cannot write JUnit report to %s: %v", *junitReport, err)
+		}
+	}
+	if *changedMarker != "" {
+		if err := touchChanged(*changedMarker, results); err != nil {
+			log.Printf("Cannot write changed marker %s: %v", *changedMarker, err)
+		}
+	}
+	if *statusFile != "" {
+		if err := writeStatus(*statusFile, results, started); err != nil {
+			log.Printf("Cannot write status to %s: %v", *statusFile, err)
+		}
+	}
+	if *metricsTextfile != "" {
+		if err := writeMetrics(*metricsTextfile, results); err != nil {
+			log.Printf("Cannot write metrics to %s: %v", *metricsTextfile, err)
+		}
+	}
+	return results, err
+}
+
 func main() {
 
 	flag.Parse()
-	if randomDelay != nil && *randomDelay != "" {
+	if *once {
+		*interval = 0
+	}
+	if *logFile != "" {
+		if w, err := openCappedLog(*logFile, *maxLogBytes); err != nil {
+			log.Fatalf("Cannot open log file %s: %v", *logFile, err)
+		} else {
+			log.SetOutput(w)
+		}
+	}
+	if flag.Arg(0) == "serve" {
+		log.Fatal(serveMirror(*listenAddr, *directory))
+	}
+	if flag.Arg(0) == "status" {
+		fs := flag.NewFlagSet("status", flag.ExitOnError)
+		history := fs.Bool("history", false, "Also show the recent HTTP statuses of each product")
+		fs.Parse(flag.Args()[1:])
+		if err := reportStatus(os.Stdout, *history); err != nil {
+			log.Fatalf("Can't report status: %v", err)
+		}
+		return
+	}
+	if *reportAges {
+		if err := reportBuildAges(os.Stdout, *directory); err != nil {
+			log.Fatalf("Can't report build ages: %v", err)
+		}
+		return
+	}
+	if *reportStaleDbs {
+		stale, err := reportStale(os.Stdout, *directory, *maxAge)
+		if err != nil {
+			log.Fatalf("Can't report stale databases: %v", err)
+		}
+		if stale {
+			os.Exit(1)
+		}
+		return
+	}
+	if *verifyOnly {
+		ok, err := reportVerify(os.Stdout, *directory, *reportFormat)
+		if err != nil {
+			log.Fatalf("Can't verify databases: %v", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if *manifestFile != "" {
+		if err := exportManifest(*manifestFile); err != nil {
+			log.Fatalf("Can't export manifest: %v", err)
+		}
+		return
+	}
+	if *linksDryRun {
+		reportLinks(os.Stdout)
+		return
+	}
+	if *since != "" {
+		dur, err := parseAge(*since)
+		if err != nil {
+			log.Fatalf("Cannot parse duration '%s': %v", *since, err)
+		}
+		if err := reportSince(os.Stdout, dur); err != nil {
+			log.Fatalf("Can't report changes: %v", err)
+		}
+		return
+	}
+	jitterPct := 0.0
+	if *jitter != "" {
+		var err error
+		if jitterPct, err = parsePercent(*jitter); err != nil {
+			log.Fatalf("Cannot parse interval jitter '%s': %v", *jitter, err)
+		}
+	}
+	setupClient()
+	if flag.Arg(0) == "ping" {
+		if err := ping(os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if *licenseKeyStdin && !flagGiven("licensekey") {
+		key, err := readLicenseKey(os.Stdin)
+		if err != nil {
+			log.Printf("Cannot read license key: %v", err)
+			os.Exit(4)
+		}
+		*licenseKey = key
+	}
+	if problems := configProblems(); len(problems) > 0 {
+		log.Printf("Invalid configuration:")
+		for _, p := range problems {
+			log.Printf("  %s", p)
+		}
+		os.Exit(4)
+	}
+	warnLegacyDefaults()
+	if *tempDir != "" {
+		if err := checkTempDir(); err != nil {
+			log.Printf("Invalid configuration: %v", err)
+			os.Exit(4)
+		}
+	}
+	proto, _ = newProtocol(*updateProto)
+	if *maxDecompress > 0 {
+		decompressSlots = make(chan struct{}, *maxDecompress)
+	}
+	handleSignals()
+	if *progressFd >= 0 {
+		openProgress(*progressFd)
+	}
+	if *signatureUrl != "" {
+		var err error
+		if signingKey, err = loadPublicKey(*publicKey); err != nil {
+			log.Fatalf("Cannot load public key %s: %v", *publicKey, err)
+		}
+	}
+	if *dryRun {
+		if err := reportDryRun(os.Stdout, splitList(*productIds)); err != nil {
+			log.Fatalf("Can't report dry run: %v", err)
+		}
+		return
+	}
+	if reason := delaySkipReason(isTerminal(os.Stdout)); *randomDelay != "" && reason != "" {
+		log.Printf("Skipping --randomdelay %s: %s", *randomDelay, reason)
+	} else if randomDelay != nil && *randomDelay != "" {
 		if dur, err := time.ParseDuration(*randomDelay); err != nil {
-			log.Fatalf("Cannot parse duration '%s': %v", randomDelay, err)
+			log.Fatalf("Cannot parse duration '%s': %v", *randomDelay, err)
 		} else {
 			rdur := time.Duration(randInt64(dur.Nanoseconds()))
 			log.Printf("Waiting for %s of %s", rdur.String(), dur.String())
@@ -185,17 +1079,57 @@ func main() {
 		}
 	}
 
-	log.Printf("Updating geoip database at %s from %s via %s", *directory, *sourceHost, *protocol)
-	if err := getClientIp(); err != nil {
-		log.Fatalf("Can't get client IP: %v", err)
+	if *waitNetwork > 0 {
+		waitForNetwork(*waitNetwork)
 	}
-	for _, p := range strings.Split(*productIds, ",") {
-		getProduct(p)
+
+	if *preflightCheck && *mirrorUrl == "" {
+		if err := preflight(splitList(*productIds)[0]); err != nil {
+			if _, ok := err.(*authError); ok {
+				log.Printf("License invalid or expired: %v", err)
+				os.Exit(4)
+			}
+			log.Printf("Pre-flight check failed: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Pre-flight check passed")
 	}
-	if *dolinks {
-		log.Printf("Making legacy links in %s", *directory)
-		os.Symlink(path.Join(*directory, "GeoLiteCity.dat"), path.Join(*directory, "GeoIPCity.dat"))
-		os.Symlink(path.Join(*directory, "GeoLiteCountry.dat"), path.Join(*directory, "GeoIP.dat"))
+	if *verifyConsistency {
+		checkMirrorConsistency(splitList(*productIds))
+	}
+	if *interval <= 0 {
+		results, err := cycle(false)
+		if code := oneShotStatus(results, err); code != 0 {
+			os.Exit(code)
+		}
+		return
+	}
+	failedCycles := 0
+	for resume := true; ; resume = false {
+		started := time.Now()
+		results, err := cycle(resume)
+		if *cycleReportFormat != "" {
+			if err := writeCycleReport(os.Stdout, *cycleReportFormat, results, started, err); err != nil {
+				log.Printf("Cannot write cycle report: %v", err)
+			}
+		}
+		if err != nil || exitCode(results) != 0 {
+			failedCycles++
+		} else {
+			failedCycles = 0
+		}
+		if *maxFailedCycles > 0 && failedCycles >= *maxFailedCycles {
+			log.Printf("Exiting after %d consecutive cycles with failures", failedCycles)
+			os.Exit(1)
+		}
+		if !*keepIdle {
+			client.CloseIdleConnections()
+		}
+		sleep := jitterDuration(*interval, jitterPct)
+		if breaker.isOpen() {
+			sleep *= 2
+		}
+		log.Printf("Next update in %s", sleep.String())
+		time.Sleep(sleep)
 	}
-	log.Printf("Done\n")
 }
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testServer starts h and points --source at it, with --directory a fresh
+// temporary directory.
+func testServer(t *testing.T, h http.Handler) *httptest.Server {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	withFlag(t, sourceHost, strings.TrimPrefix(srv.URL, "http://"))
+	withFlag(t, protocol, "http")
+	withFlag(t, directory, t.TempDir())
+	return srv
+}
+
+func gzipped(data []byte) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// A v2Server serves databases by edition ID over the v2 protocol,
+// answering 304 when db_md5 is the digest of the current database.
+type v2Server struct {
+	lock     sync.Mutex
+	dbs      map[string][]byte
+	requests []string
+	header   http.Header
+	// bodies, if set for an edition, is sent instead of its gzipped
+	// database.
+	bodies map[string][]byte
+}
+
+func newV2Server(t *testing.T, dbs map[string][]byte) *v2Server {
+	s := &v2Server{dbs: dbs, header: make(http.Header), bodies: make(map[string][]byte)}
+	testServer(t, s)
+	withFlag(t, updateProto, "v2")
+	withFlag(t, accountId, "42")
+	old := proto
+	proto = V2Protocol{}
+	t.Cleanup(func() { proto = old })
+	return s
+}
+
+func (s *v2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+	for k, v := range s.header {
+		w.Header()[k] = v
+	}
+	if r.URL.Path == filenamePath {
+		w.Write([]byte(r.URL.Query().Get("product_id") + ".mmdb"))
+		return
+	}
+	edition := path.Base(path.Dir(r.URL.Path))
+	db, ok := s.dbs[edition]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("db_md5") == md5Hex(db) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if w.Header().Get(*md5Header) == "" {
+		w.Header().Set(*md5Header, md5Hex(db))
+	}
+	if body, ok := s.bodies[edition]; ok {
+		w.Write(body)
+		return
+	}
+	w.Write(gzipped(db))
+}
+
+func (s *v2Server) uris() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func installed(t *testing.T, filename string) []byte {
+	data, err := ioutil.ReadFile(path.Join(*directory, filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestExitCode(t *testing.T) {
+	withFlag(t, productIds, "a,b,c,d,e,f,g")
+	failed := func(ids ...string) []productResult {
+		var results []productResult
+		for _, id := range ids {
+			results = append(results, productResult{ProductId: id, Err: ErrProductNotFound})
+		}
+		return append(results, productResult{ProductId: "c"})
+	}
+	for _, c := range []struct {
+		failed []string
+		want   int
+	}{
+		{nil, 0},
+		{[]string{"a"}, 65},
+		{[]string{"b", "e"}, 64 + 2 + 16},
+		{[]string{"f"}, 96},
+		{[]string{"a", "b", "d", "e", "f", "g"}, 64 + 1 + 2 + 8 + 16 + 32},
+	} {
+		code := exitCode(failed(c.failed...))
+		if code != c.want {
+			t.Errorf("%v failed: exit code %d, want %d", c.failed, code, c.want)
+		}
+		if code == 1 || code == 2 || code == 4 || code > 127 {
+			t.Errorf("%v failed: exit code %d collides with a reserved status", c.failed, code)
+		}
+	}
+}
+
+func TestUnreadableInstalledFileForcesDownload(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	s := newV2Server(t, map[string][]byte{"GeoLite2-City": db})
+	// A symlink loop exists but cannot be read.
+	filePath := path.Join(*directory, "GeoLite2-City.mmdb")
+	if err := os.Symlink(filePath, filePath); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := getProduct("GeoLite2-City"); err != nil || !changed {
+		t.Fatalf("changed=%v err=%v, want a forced download", changed, err)
+	}
+	uris := s.uris()
+	if last := uris[len(uris)-1]; !strings.Contains(last, "db_md5="+emptyDigest) {
+		t.Fatalf("update request %s did not send the empty digest", last)
+	}
+	if !bytes.Equal(installed(t, "GeoLite2-City.mmdb"), db) {
+		t.Fatal("database not installed")
+	}
+}
+
+func TestUnixSocketSource(t *testing.T) {
+	sock := path.Join(t.TempDir(), "mirror.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var host string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.Write([]byte("GeoLite2-City.mmdb"))
+	}))
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	withFlag(t, sourceHost, unixPrefix+sock)
+	withFlag(t, hostHeader, "mirror.internal")
+	withFlag(t, protocol, "http")
+	old := client.Transport
+	t.Cleanup(func() { client.Transport = old })
+	setupClient()
+
+	filename, err := resolveFilename(proto, "GeoLite2-City")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename != "GeoLite2-City.mmdb" || host != "mirror.internal" {
+		t.Fatalf("filename %q with Host %q", filename, host)
+	}
+}
+
+func TestFailedVerificationKeepsOldDatabase(t *testing.T) {
+	for _, keep := range []bool{false, true} {
+		old := testMMDB("GeoLite2-City", 1000)
+		// Valid metadata, but a search tree bigger than the file.
+		bad := append(make([]byte, 8), testMetadata("GeoLite2-City", 2000, 1000, 24)...)
+		newV2Server(t, map[string][]byte{"GeoLite2-City": bad})
+		withBool(t, keepFailed, keep)
+		filePath := path.Join(*directory, "GeoLite2-City.mmdb")
+		if err := ioutil.WriteFile(filePath, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := getProduct("GeoLite2-City"); err == nil {
+			t.Fatalf("keep=%v: corrupt download installed", keep)
+		}
+		if !bytes.Equal(installed(t, "GeoLite2-City.mmdb"), old) {
+			t.Fatalf("keep=%v: old database changed", keep)
+		}
+		failed, err := ioutil.ReadFile(filePath + ".failed")
+		if keep && !bytes.Equal(failed, bad) {
+			t.Fatalf("keep=%v: failed download not kept: %v", keep, err)
+		}
+		if !keep && !os.IsNotExist(err) {
+			t.Fatalf("keep=%v: failed download kept", keep)
+		}
+		if tmps, _ := filepath.Glob(filePath + ".*.tmp"); len(tmps) > 0 {
+			t.Fatalf("keep=%v: temporary files left: %q", keep, tmps)
+		}
+	}
+}
+
+func TestGunzipTrailingBytes(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	data := append(gzipped(db), "\nsignature\n"...)
+	if _, err := gunzip(data); err == nil {
+		t.Fatal("strict gunzip accepted trailing bytes")
+	}
+	withBool(t, tolerantGzip, true)
+	got, err := gunzip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, db) {
+		t.Fatal("tolerant gunzip returned the wrong data")
+	}
+}
+
+func TestConcurrentInstallsOfOneProduct(t *testing.T) {
+	withFlag(t, directory, t.TempDir())
+	filePath := path.Join(*directory, "GeoLite2-City.mmdb")
+	dbs := [][]byte{testMMDB("GeoLite2-City", 1000), testMMDB("GeoLite2-City", 2000)}
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(db []byte) {
+			defer wg.Done()
+			if err := installFile("GeoLite2-City", "GeoLite2-City.mmdb", filePath, db); err != nil && err != errSameContent {
+				errs <- err
+			}
+		}(dbs[i%2])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	got := installed(t, "GeoLite2-City.mmdb")
+	if !bytes.Equal(got, dbs[0]) && !bytes.Equal(got, dbs[1]) {
+		t.Fatal("installed database is a mixture of two downloads")
+	}
+	if tmps, _ := filepath.Glob(filePath + ".*.tmp"); len(tmps) > 0 {
+		t.Fatalf("temporary files left: %q", tmps)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		fn := tempPath(filePath)
+		releaseTemp(fn)
+		if seen[fn] {
+			t.Fatalf("temporary path %s handed out twice", fn)
+		}
+		seen[fn] = true
+	}
+}
+
+func TestInstallThroughSymlink(t *testing.T) {
+	for _, through := range []bool{false, true} {
+		withFlag(t, directory, t.TempDir())
+		withBool(t, throughSymlink, through)
+		filePath := path.Join(*directory, "GeoLite2-City.mmdb")
+		target := path.Join(*directory, "GeoLite2-City-1000.mmdb")
+		old := testMMDB("GeoLite2-City", 1000)
+		if err := ioutil.WriteFile(target, old, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(path.Base(target), filePath); err != nil {
+			t.Fatal(err)
+		}
+		db := testMMDB("GeoLite2-City", 2000)
+		if err := installFile("GeoLite2-City", "GeoLite2-City.mmdb", filePath, db); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLink := fi.Mode()&os.ModeSymlink != 0; isLink != through {
+			t.Fatalf("through=%v: symlink kept=%v", through, isLink)
+		}
+		if !bytes.Equal(installed(t, "GeoLite2-City.mmdb"), db) {
+			t.Fatalf("through=%v: new database not installed", through)
+		}
+		want := old
+		if through {
+			want = db
+		}
+		if !bytes.Equal(installed(t, path.Base(target)), want) {
+			t.Fatalf("through=%v: wrong content in the link target", through)
+		}
+	}
+}
+
+// tamperedGzip returns a gzip of data with byte i of its 8-byte trailer
+// flipped: 0-3 are the CRC32, 4-7 the size.
+func tamperedGzip(data []byte, i int) []byte {
+	gz := gzipped(data)
+	gz[len(gz)-8+i] ^= 0xff
+	return gz
+}
+
+func TestCheckGzipTrailer(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	sum, n := crc32.ChecksumIEEE(db), int64(len(db))
+	if err := checkGzipTrailer(gzipped(db), sum, n); err != nil {
+		t.Fatal(err)
+	}
+	for name, gz := range map[string][]byte{
+		"crc":       tamperedGzip(db, 0),
+		"size":      tamperedGzip(db, 4),
+		"truncated": gzipped(db)[:5],
+	} {
+		if err := checkGzipTrailer(gz, sum, n); err == nil {
+			t.Errorf("%s: corrupt trailer accepted", name)
+		}
+	}
+}
+
+func TestTamperedGzipTrailerNotInstalled(t *testing.T) {
+	for _, i := range []int{0, 4} {
+		db := testMMDB("GeoLite2-City", 1000)
+		s := newV2Server(t, map[string][]byte{"GeoLite2-City": db})
+		s.bodies["GeoLite2-City"] = tamperedGzip(db, i)
+		if _, err := getProduct("GeoLite2-City"); err == nil {
+			t.Fatalf("trailer byte %d: tampered download accepted", i)
+		}
+		if _, err := os.Stat(path.Join(*directory, "GeoLite2-City.mmdb")); !os.IsNotExist(err) {
+			t.Fatalf("trailer byte %d: tampered download installed", i)
+		}
+	}
+}
+
+func TestDelaySkipReason(t *testing.T) {
+	for _, c := range []struct {
+		noDelay, forceDelay, terminal bool
+		skip                          bool
+	}{
+		{false, false, false, false},
+		{false, false, true, true},
+		{false, true, true, false},
+		{true, false, false, true},
+		{true, true, false, true},
+		{true, true, true, true},
+	} {
+		withBool(t, noDelay, c.noDelay)
+		withBool(t, forceDelay, c.forceDelay)
+		if reason := delaySkipReason(c.terminal); (reason != "") != c.skip {
+			t.Errorf("--no-delay=%v --force-delay=%v terminal=%v: reason %q, want skip=%v",
+				c.noDelay, c.forceDelay, c.terminal, reason, c.skip)
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	f, err := ioutil.TempFile(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if isTerminal(null) || isTerminal(f) {
+		t.Fatal("/dev/null or a regular file taken for a terminal")
+	}
+}
+
+// dirSnapshot lists the names, sizes and modification times in dir.
+func dirSnapshot(t *testing.T, dir string) map[string]string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := make(map[string]string)
+	for _, fi := range entries {
+		snap[fi.Name()] = fi.ModTime().String() + " " + strconv.FormatInt(fi.Size(), 10)
+	}
+	return snap
+}
+
+func TestUpToDateRunWritesNothing(t *testing.T) {
+	for _, c := range []struct {
+		name         string
+		mirror       bool
+		cacheControl string
+	}{
+		{"v2", false, ""},
+		{"v2 with Cache-Control", false, "max-age=3600"},
+		{"mirror 304 with Cache-Control", true, "max-age=3600"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			db := testMMDB("GeoLite2-City", 1000)
+			if c.mirror {
+				m := newTestMirror(t, db)
+				m.cacheControl = c.cacheControl
+				// Install through the mirror so that its ETag is cached.
+				if _, err := getMirrorProduct("GeoLite2-City"); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				s := newV2Server(t, map[string][]byte{"GeoLite2-City": db})
+				s.header.Set("Cache-Control", c.cacheControl)
+				if err := ioutil.WriteFile(path.Join(*directory, "GeoLite2-City.mmdb"), db, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			withBool(t, dolinks, true)
+			makeLinks()
+			before := dirSnapshot(t, *directory)
+			// Only effective when not running as root; the snapshot covers that.
+			if err := os.Chmod(*directory, 0555); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chmod(*directory, 0755)
+			results, err := update([]string{"GeoLite2-City"})
+			if err != nil || results[0].Err != nil || results[0].Changed {
+				t.Fatalf("update: %v %+v", err, results)
+			}
+			if after := dirSnapshot(t, *directory); !reflect.DeepEqual(before, after) {
+				t.Fatalf("directory changed from %v to %v", before, after)
+			}
+		})
+	}
+}
+
+// newLegacyServer serves GeoLite2-City.mmdb over the legacy protocol,
+// answering each update request with respond(n, db_md5), where n counts
+// update requests from 1.
+func newLegacyServer(t *testing.T, respond func(n int, digest string) []byte) *int {
+	n := 0
+	testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == filenamePath {
+			w.Write([]byte("GeoLite2-City.mmdb"))
+			return
+		}
+		n++
+		w.Write(respond(n, r.URL.Query().Get("db_md5")))
+	}))
+	withFlag(t, updateProto, "legacy")
+	old, oldIp := proto, clientIp
+	proto, clientIp = LegacyProtocol{}, "192.0.2.1"
+	t.Cleanup(func() { proto, clientIp = old, oldIp })
+	return &n
+}
+
+func TestUpdateLoopStates(t *testing.T) {
+	v1, v2, v3 := testMMDB("GeoLite2-City", 1000), testMMDB("GeoLite2-City", 2000), testMMDB("GeoLite2-City", 3000)
+	// current answers "no update" for db and sends it otherwise.
+	current := func(db []byte) func(int, string) []byte {
+		return func(_ int, digest string) []byte {
+			if digest == md5Hex(db) {
+				return noUpdatesBody
+			}
+			return gzipped(db)
+		}
+	}
+	for _, c := range []struct {
+		name      string
+		installed []byte
+		respond   func(int, string) []byte
+		changed   bool
+		err       string
+		requests  int
+		want      []byte
+	}{
+		{"installed and current", v1, current(v1), false, "", 1, v1},
+		{"download confirmed", v1, current(v2), true, "", 2, v2},
+		{"first install", nil, current(v1), true, "", 2, v1},
+		{"not installed", nil, func(int, string) []byte { return noUpdatesBody }, false, "which is not installed", 1, nil},
+		{"superseded download", v1, func(n int, digest string) []byte {
+			if n == 1 {
+				return gzipped(v2)
+			}
+			return current(v3)(n, digest)
+		}, true, "", 3, v3},
+		{"never confirmed", v1, func(n int, _ string) []byte {
+			return gzipped(testMMDB("GeoLite2-City", uint64(2000+n)))
+		}, false, "Too many attempts", 6, v1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			n := newLegacyServer(t, c.respond)
+			filePath := path.Join(*directory, "GeoLite2-City.mmdb")
+			if c.installed != nil {
+				if err := ioutil.WriteFile(filePath, c.installed, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			changed, err := getProduct("GeoLite2-City")
+			if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Fatalf("err = %v, want %q", err, c.err)
+			}
+			if changed != c.changed || *n != c.requests {
+				t.Fatalf("changed=%v after %d update requests, want changed=%v after %d", changed, *n, c.changed, c.requests)
+			}
+			data, _ := ioutil.ReadFile(filePath)
+			if !bytes.Equal(data, c.want) {
+				t.Fatal("wrong database installed")
+			}
+		})
+	}
+}
+
+func TestOneShotStatus(t *testing.T) {
+	withFlag(t, productIds, "a,b")
+	ok := []productResult{{ProductId: "a"}, {ProductId: "b"}}
+	failed := []productResult{{ProductId: "a"}, {ProductId: "b", Err: ErrProductNotFound}}
+	sweepErr := errors.New("Post-run sweep found 1 invalid database")
+	for _, bitmap := range []bool{false, true} {
+		withBool(t, exitBitmap, bitmap)
+		if code := oneShotStatus(ok, nil); code != 0 {
+			t.Errorf("bitmap=%v: success exits %d", bitmap, code)
+		}
+		if code := oneShotStatus(ok, sweepErr); code != 1 {
+			t.Errorf("bitmap=%v: run-level error exits %d, want 1", bitmap, code)
+		}
+	}
+	if code := oneShotStatus(failed, sweepErr); code != exitBitmapBase|2 {
+		t.Errorf("failed product exits %d, want %d", code, exitBitmapBase|2)
+	}
+}
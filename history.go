@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type historyEntry struct {
+	Time     time.Time  `json:"time"`
+	Edition  string     `json:"edition"`
+	File     string     `json:"file"`
+	OldBuild *time.Time `json:"old_build,omitempty"`
+	NewBuild *time.Time `json:"new_build,omitempty"`
+}
+
+var historyLock sync.Mutex
+
+func buildTime(md *mmdbMetadata) *time.Time {
+	if md == nil {
+		return nil
+	}
+	t := time.Unix(int64(md.BuildEpoch), 0).UTC()
+	return &t
+}
+
+func recordHistory(filePath string, oldMd *mmdbMetadata, newMd *mmdbMetadata) error {
+	if *historyFile == "" {
+		return nil
+	}
+	e := historyEntry{
+		Time:     time.Now().UTC(),
+		Edition:  path.Base(filePath),
+		File:     filePath,
+		OldBuild: buildTime(oldMd),
+		NewBuild: buildTime(newMd),
+	}
+	if newMd != nil && newMd.DatabaseType != "" {
+		e.Edition = newMd.DatabaseType
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	historyLock.Lock()
+	defer historyLock.Unlock()
+	f, err := os.OpenFile(*historyFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readHistory(fn string) ([]historyEntry, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []historyEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func parseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+func formatBuild(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format("2006-01-02")
+}
+
+func reportSince(w io.Writer, since time.Duration) error {
+	if *historyFile == "" {
+		return errors.New("--since requires --history-file")
+	}
+	entries, err := readHistory(*historyFile)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-since)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANGED\tEDITION\tOLD BUILD\tNEW BUILD\tFILE")
+	for _, e := range entries {
+		if e.Time.Before(cutoff) {
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Format(time.RFC3339),
+			e.Edition,
+			formatBuild(e.OldBuild),
+			formatBuild(e.NewBuild),
+			path.Base(e.File))
+	}
+	return tw.Flush()
+}
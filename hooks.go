@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// A hookError is a --product-hook command that failed.
+type hookError struct {
+	msg string
+}
+
+func (e *hookError) Error() string {
+	return e.msg
+}
+
+var (
+	hookErrors     = make(map[string]error)
+	hookErrorsLock sync.Mutex
+)
+
+// takeHookError returns and forgets the failure of the last hook run for
+// productId, if it failed. A failed hook does not undo the install.
+func takeHookError(productId string) error {
+	hookErrorsLock.Lock()
+	defer hookErrorsLock.Unlock()
+	err := hookErrors[productId]
+	delete(hookErrors, productId)
+	return err
+}
+
+func parseProductHooks() (map[string][]string, error) {
+	hooks := make(map[string][]string)
+	for _, h := range *productHooks {
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || len(strings.Fields(kv[1])) == 0 {
+			return nil, errors.New("Expected product=command, got '" + h + "'")
+		}
+		hooks[strings.TrimSpace(kv[0])] = strings.Fields(kv[1])
+	}
+	return hooks, nil
+}
+
+// runProductHook runs the --product-hook command of productId, if any,
+// with the product ID and installed path as its last two arguments.
+func runProductHook(productId string, filePath string) error {
+	hooks, err := parseProductHooks()
+	if err != nil {
+		return err
+	}
+	args, ok := hooks[productId]
+	if !ok {
+		return nil
+	}
+	log.Printf("Running hook for %s: %s", productId, strings.Join(args, " "))
+	out, err := exec.Command(args[0], append(args[1:], productId, filePath)...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	for _, l := range strings.Split(string(bytes.TrimSpace(out)), "\n") {
+		if l != "" {
+			log.Printf("Hook for %s: %s", productId, l)
+		}
+	}
+	return &hookError{"Hook for " + productId + " failed: " + err.Error()}
+}
+
+func hookFailed(results []productResult) bool {
+	for _, r := range results {
+		if r.HookErr != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFailedHookKeepsInstall(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	newV2Server(t, map[string][]byte{"GeoLite2-City": db})
+	old := *productHooks
+	*productHooks = []string{"GeoLite2-City=false"}
+	t.Cleanup(func() { *productHooks = old })
+	withBool(t, hookRequired, true)
+	withFlag(t, productIds, "GeoLite2-City")
+
+	r := runProduct("GeoLite2-City", getProduct)
+	if r.Err != nil || !r.Changed {
+		t.Fatalf("result = %+v, want changed without error", r)
+	}
+	if r.HookErr == nil || !hookFailed([]productResult{r}) {
+		t.Fatal("hook failure not reported")
+	}
+	if !bytes.Equal(installed(t, "GeoLite2-City.mmdb"), db) {
+		t.Fatal("database not installed")
+	}
+	if code := exitCode([]productResult{r}); code != exitBitmapBase|1 {
+		t.Fatalf("exit code = %d, want %d", code, exitBitmapBase|1)
+	}
+}
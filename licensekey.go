@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"io"
+	"strings"
+)
+
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// readLicenseKey returns the first line of r, trimmed, leaving the rest
+// unread.
+func readLicenseKey(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	key := strings.TrimSpace(line)
+	if key == "" {
+		return "", errors.New("No license key on stdin")
+	}
+	return key, nil
+}
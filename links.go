@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+type legacyLink struct {
+	Target string
+	Link   string
+}
+
+var legacyLinks = []legacyLink{
+	{Target: "GeoLiteCity.dat", Link: "GeoIPCity.dat"},
+	{Target: "GeoLiteCountry.dat", Link: "GeoIP.dat"},
+}
+
+// dest is what the link should contain: the bare target name with
+// --relative-symlinks, so that the link survives moving the directory.
+func (l legacyLink) dest() string {
+	if *relativeLinks {
+		return l.Target
+	}
+	return path.Join(*directory, l.Target)
+}
+
+// makeLinks only creates missing links, so that it writes nothing to a
+// directory whose links are already in place.
+func makeLinks() {
+	for _, l := range legacyLinks {
+		link := path.Join(*directory, l.Link)
+		if _, err := os.Lstat(link); err == nil {
+			continue
+		}
+		os.Symlink(l.dest(), link)
+	}
+}
+
+// linksDisabled says why the legacy links are not to be made, if they
+// are not.
+func linksDisabled() string {
+	switch {
+	case !*dolinks:
+		return "--links=false given"
+	case *secure && !*forceLinks:
+		return "secure mode (use --force-links to override)"
+	}
+	return ""
+}
+
+func reportLinks(w io.Writer) {
+	if reason := linksDisabled(); reason != "" {
+		fmt.Fprintf(w, "links disabled: %s\n", reason)
+		return
+	}
+	for _, l := range legacyLinks {
+		target := path.Join(*directory, l.Target)
+		link := path.Join(*directory, l.Link)
+		action := "create"
+		detail := "-> " + l.dest()
+		if fi, err := os.Lstat(link); err == nil {
+			action = "leave"
+			if fi.Mode()&os.ModeSymlink == 0 {
+				detail = "(not a symlink)"
+			} else if dest, err := os.Readlink(link); err != nil {
+				detail = "(" + err.Error() + ")"
+			} else if dest != l.dest() {
+				detail = "-> " + dest + " (not " + l.dest() + ")"
+			} else {
+				detail = "-> " + dest
+			}
+		}
+		if _, err := os.Stat(target); err != nil {
+			detail += " [target missing]"
+		}
+		fmt.Fprintf(w, "%s %s %s\n", action, link, detail)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLinkForms(t *testing.T) {
+	for _, relative := range []bool{false, true} {
+		withFlag(t, directory, t.TempDir())
+		withBool(t, relativeLinks, relative)
+		if err := ioutil.WriteFile(path.Join(*directory, "GeoLiteCity.dat"), []byte("city"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		makeLinks()
+		dest, err := os.Readlink(path.Join(*directory, "GeoIPCity.dat"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := path.Join(*directory, "GeoLiteCity.dat")
+		if relative {
+			want = "GeoLiteCity.dat"
+		}
+		if dest != want {
+			t.Fatalf("relative=%v: link points to %q, want %q", relative, dest, want)
+		}
+		if data, err := ioutil.ReadFile(path.Join(*directory, "GeoIPCity.dat")); err != nil || string(data) != "city" {
+			t.Fatalf("relative=%v: link does not resolve: %v", relative, err)
+		}
+	}
+}
+
+func TestReportLinksHonoursLinkSettings(t *testing.T) {
+	withFlag(t, directory, t.TempDir())
+	for _, c := range []struct {
+		links, secure, force bool
+		disabled             bool
+	}{
+		{true, false, false, false},
+		{false, false, false, true},
+		{true, true, false, true},
+		{true, true, true, false},
+	} {
+		withBool(t, dolinks, c.links)
+		withBool(t, secure, c.secure)
+		withBool(t, forceLinks, c.force)
+		var b bytes.Buffer
+		reportLinks(&b)
+		out := b.String()
+		if disabled := strings.HasPrefix(out, "links disabled"); disabled != c.disabled {
+			t.Errorf("--links=%v --secure=%v --force-links=%v: %q", c.links, c.secure, c.force, out)
+		}
+		if c.disabled && strings.Contains(out, "create") {
+			t.Errorf("disabled links reported as created: %q", out)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"os"
+)
+
+type cappedLog struct {
+	f    *os.File
+	max  int64
+	size int64
+}
+
+func openCappedLog(fn string, max int64) (*cappedLog, error) {
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cappedLog{f: f, max: max, size: fi.Size()}, nil
+}
+
+func (l *cappedLog) trim(keep int64) error {
+	var tail []byte
+	if keep > 0 && l.size > 0 {
+		if keep > l.size {
+			keep = l.size
+		}
+		r, err := os.Open(l.f.Name())
+		if err != nil {
+			return err
+		}
+		tail = make([]byte, keep)
+		_, err = r.ReadAt(tail, l.size-keep)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if i := bytes.IndexByte(tail, '\n'); i >= 0 {
+			tail = tail[i+1:]
+		}
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	n, err := l.f.Write(tail)
+	l.size = int64(n)
+	return err
+}
+
+func (l *cappedLog) Write(p []byte) (int, error) {
+	written := len(p)
+	if l.max > 0 && l.size+int64(len(p)) > l.max {
+		if int64(len(p)) > l.max {
+			p = p[int64(len(p))-l.max:]
+		}
+		if err := l.trim(l.max/2 - int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return written, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const lastSuccessMetric = "geoipupdate_last_success_timestamp_seconds"
+
+func metricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func previousLastSuccess(fn string) float64 {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == lastSuccessMetric {
+			v, _ := strconv.ParseFloat(fields[1], 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func writeMetrics(fn string, results []productResult) error {
+	now := time.Now()
+	lastSuccess := previousLastSuccess(fn)
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		lastSuccess = float64(now.Unix())
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# HELP geoipupdate_last_run_timestamp_seconds Time of the last update run.\n")
+	fmt.Fprintf(&b, "# TYPE geoipupdate_last_run_timestamp_seconds gauge\n")
+	fmt.Fprintf(&b, "geoipupdate_last_run_timestamp_seconds %d\n", now.Unix())
+	fmt.Fprintf(&b, "# HELP %s Time of the last update run in which every product succeeded.\n", lastSuccessMetric)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", lastSuccessMetric)
+	fmt.Fprintf(&b, "%s %.0f\n", lastSuccessMetric, lastSuccess)
+	fmt.Fprintf(&b, "# HELP geoipupdate_product_errors Whether the product failed to update in the last run.\n")
+	fmt.Fprintf(&b, "# TYPE geoipupdate_product_errors gauge\n")
+	for _, r := range results {
+		v := 0
+		if r.Err != nil {
+			v = 1
+		}
+		fmt.Fprintf(&b, "geoipupdate_product_errors{product=\"%s\",host=\"%s\",protocol=\"%s\"} %d\n",
+			metricLabel(r.ProductId), metricLabel(r.Host), metricLabel(r.Protocol), v)
+	}
+	fmt.Fprintf(&b, "# HELP geoipupdate_product_retries Number of request retries the product needed in the last run.\n")
+	fmt.Fprintf(&b, "# TYPE geoipupdate_product_retries gauge\n")
+	for _, r := range results {
+		fmt.Fprintf(&b, "geoipupdate_product_retries{product=\"%s\"} %d\n", metricLabel(r.ProductId), r.Retries)
+	}
+	if dbs, err := installedDatabases(*directory); err == nil {
+		fmt.Fprintf(&b, "# HELP geoipupdate_database_age_seconds Age of the installed database build.\n")
+		fmt.Fprintf(&b, "# TYPE geoipupdate_database_age_seconds gauge\n")
+		for _, db := range dbs {
+			fmt.Fprintf(&b, "geoipupdate_database_age_seconds{edition=\"%s\",file=\"%s\"} %.0f\n",
+				metricLabel(db.Metadata.DatabaseType), metricLabel(path.Base(db.Path)), now.Sub(db.BuildTime()).Seconds())
+		}
+		fmt.Fprintf(&b, "# HELP geoipupdate_database_size_bytes Size of the installed database.\n")
+		fmt.Fprintf(&b, "# TYPE geoipupdate_database_size_bytes gauge\n")
+		for _, db := range dbs {
+			fmt.Fprintf(&b, "geoipupdate_database_size_bytes{edition=\"%s\",file=\"%s\"} %d\n",
+				metricLabel(db.Metadata.DatabaseType), metricLabel(path.Base(db.Path)), db.Size)
+		}
+	}
+	fmt.Fprintf(&b, "# EOF\n")
+
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
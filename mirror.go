@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type sidecar struct {
+	ETag       string    `json:"etag,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Product    string    `json:"product,omitempty"`
+	FreshUntil time.Time `json:"fresh_until,omitempty"`
+}
+
+func sidecarPath(filePath string) string {
+	return filePath + ".meta"
+}
+
+func readSidecar(filePath string) sidecar {
+	var sc sidecar
+	if data, err := ioutil.ReadFile(sidecarPath(filePath)); err == nil {
+		if err := json.Unmarshal(data, &sc); err != nil {
+			log.Printf("Ignoring unreadable %s: %v", sidecarPath(filePath), err)
+		}
+	}
+	return sc
+}
+
+func writeSidecar(filePath string, sc sidecar) error {
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sidecarPath(filePath), data, 0644)
+}
+
+func cacheMaxAge(res *http.Response) (time.Duration, bool) {
+	for _, d := range strings.Split(res.Header.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(d)
+		if d == "no-cache" || d == "no-store" {
+			return 0, false
+		}
+		if strings.HasPrefix(d, "max-age=") {
+			if n, err := strconv.Atoi(strings.TrimPrefix(d, "max-age=")); err == nil && n > 0 {
+				return time.Duration(n) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func freshUntil(res *http.Response) time.Time {
+	if d, ok := cacheMaxAge(res); ok {
+		return time.Now().Add(d).UTC()
+	}
+	return time.Time{}
+}
+
+// checkFresh reports whether the server said, through Cache-Control, that
+// the installed copy of filePath needs no re-check yet. Only the daemon
+// honours this.
+func checkFresh(filename string, filePath string, source string) bool {
+	if *ignoreCacheControl || *interval <= 0 {
+		return false
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		return false
+	}
+	sc := readSidecar(filePath)
+	if sc.Source != source || !time.Now().Before(sc.FreshUntil) {
+		return false
+	}
+	log.Printf("Not checking %s, fresh until %s according to Cache-Control", filename, sc.FreshUntil.Format(time.RFC3339))
+	return true
+}
+
+// freshFilename finds the installed file that checkFresh would skip for
+// productId, so that the update protocol can skip it without first asking
+// the server for its filename.
+func freshFilename(productId string, source string) (string, bool) {
+	metas, _ := filepath.Glob(path.Join(*directory, "*.meta"))
+	for _, m := range metas {
+		filePath := strings.TrimSuffix(m, ".meta")
+		if readSidecar(filePath).Product != productId {
+			continue
+		}
+		filename := path.Base(filePath)
+		return filename, checkFresh(filename, filePath, source)
+	}
+	return "", false
+}
+
+// recordFreshness stores how long the server says filePath stays fresh.
+// Only the daemon reads it, and an unchanged sidecar is not rewritten, so
+// that a run in which nothing changed writes nothing.
+func recordFreshness(productId string, filePath string, source string, res *http.Response) {
+	if *interval <= 0 {
+		return
+	}
+	sc := readSidecar(filePath)
+	fu := freshUntil(res)
+	if sc.FreshUntil.Equal(fu) && (fu.IsZero() || sc.Source == source && sc.Product == productId) {
+		return
+	}
+	sc.Source = source
+	sc.Product = productId
+	sc.FreshUntil = fu
+	if err := writeSidecar(filePath, sc); err != nil {
+		log.Printf("Cannot write %s: %v", sidecarPath(filePath), err)
+	}
+}
+
+func mirrorProductUrl(productId string) (*url.URL, error) {
+	return url.Parse(strings.Replace(*mirrorUrl, "{edition}", url.PathEscape(productId), -1))
+}
+
+func mirrorFilename(u *url.URL) string {
+	return archiveBase(path.Base(u.Path))
+}
+
+func getMirrorProduct(productId string) (bool, error) {
+	u, err := mirrorProductUrl(productId)
+	if err != nil {
+		return false, err
+	}
+	filename := mirrorFilename(u)
+	log.Printf("Attempting to update %s", filename)
+	filePath := path.Join(*directory, filename)
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	source := u.Scheme + "://" + u.Host
+	if checkFresh(filename, filePath, source) {
+		logOutcome(productId, filename, false)
+		return false, nil
+	}
+	sc := readSidecar(filePath)
+	if _, err := os.Stat(filePath); err == nil && sc.ETag != "" {
+		if sc.Source == source {
+			req.Header.Set("If-None-Match", sc.ETag)
+		} else {
+			log.Printf("Ignoring cached ETag for %s from a different source", filename)
+		}
+	}
+	res, err := doWithRetries(req, productId)
+	if err != nil {
+		recordStatus(productId, 0)
+		return false, err
+	}
+	recordStatus(productId, res.StatusCode)
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		recordFreshness(productId, filePath, source, res)
+		logOutcome(productId, filename, false)
+		return false, nil
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return false, ErrProductNotFound
+	}
+	if !isSuccess(res.StatusCode) {
+		return false, errors.New("Status " + res.Status + " received")
+	}
+	if err := checkResponseSize(productId, res); err != nil {
+		return false, err
+	}
+	data, err := ioutil.ReadAll(newProgressReader(res.Body, productId, res.ContentLength))
+	if err != nil {
+		return false, err
+	}
+	if data, err = unpack(data); err != nil {
+		return false, err
+	}
+	if err := installFile(productId, filename, filePath, data); err == errNotAdvanced || err == errSameContent {
+		recordFreshness(productId, filePath, source, res)
+		logOutcome(productId, filename, false)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	logOutcome(productId, filename, true)
+	return true, writeSidecar(filePath, sidecar{ETag: res.Header.Get("ETag"), Source: source, Product: productId, FreshUntil: freshUntil(res)})
+}
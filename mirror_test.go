@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A testMirror serves one database at any path, with an ETag, and
+// answers 304 to a matching If-None-Match.
+type testMirror struct {
+	lock        sync.Mutex
+	db          []byte
+	etag        string
+	notModified int
+	conditional []string
+	// cacheControl, if set, is sent with every response.
+	cacheControl string
+}
+
+func newTestMirror(t *testing.T, db []byte) *testMirror {
+	s := &testMirror{db: db, etag: `"` + md5Hex(db) + `"`}
+	srv := testServer(t, s)
+	withFlag(t, mirrorUrl, srv.URL+"/{edition}.mmdb.gz")
+	return s
+}
+
+func (s *testMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.cacheControl != "" {
+		w.Header().Set("Cache-Control", s.cacheControl)
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		s.conditional = append(s.conditional, inm)
+		if inm == s.etag {
+			s.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write(gzipped(s.db))
+}
+
+func TestMirrorNotModified(t *testing.T) {
+	s := newTestMirror(t, testMMDB("GeoLite2-City", 1000))
+	if changed, err := getMirrorProduct("GeoLite2-City"); err != nil || !changed {
+		t.Fatalf("first update: changed=%v err=%v", changed, err)
+	}
+	r := runProduct("GeoLite2-City", getMirrorProduct)
+	if r.Err != nil || r.Changed {
+		t.Fatalf("second update: %+v, want unchanged without error", r)
+	}
+	if s.notModified != 1 {
+		t.Fatalf("server answered 304 %d times, want 1", s.notModified)
+	}
+}
+
+func TestFreshProductMakesNoRequest(t *testing.T) {
+	s := newV2Server(t, map[string][]byte{"GeoLite2-City": testMMDB("GeoLite2-City", 1000)})
+	s.header.Set("Cache-Control", "max-age=3600")
+	old := *interval
+	*interval = time.Hour
+	t.Cleanup(func() { *interval = old })
+
+	if changed, err := getProduct("GeoLite2-City"); err != nil || !changed {
+		t.Fatalf("first update: changed=%v err=%v", changed, err)
+	}
+	before := len(s.uris())
+	if changed, err := getProduct("GeoLite2-City"); err != nil || changed {
+		t.Fatalf("second update: changed=%v err=%v", changed, err)
+	}
+	if after := s.uris(); len(after) != before {
+		t.Fatalf("fresh product made requests: %q", after[before:])
+	}
+}
+
+func TestMirrorSourceChangeDropsETag(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	newTestMirror(t, db)
+	if changed, err := getMirrorProduct("GeoLite2-City"); err != nil || !changed {
+		t.Fatalf("first update: changed=%v err=%v", changed, err)
+	}
+	other := &testMirror{db: db, etag: `"` + md5Hex(db) + `"`}
+	srv := httptest.NewServer(other)
+	t.Cleanup(srv.Close)
+	withFlag(t, mirrorUrl, srv.URL+"/{edition}.mmdb.gz")
+	if _, err := getMirrorProduct("GeoLite2-City"); err != nil {
+		t.Fatal(err)
+	}
+	if len(other.conditional) != 0 {
+		t.Fatalf("new source sent the old ETag: %q", other.conditional)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbMetadataMaxSize = 128 * 1024
+
+type mmdbMetadata struct {
+	DatabaseType string
+	BuildEpoch   uint64
+	NodeCount    uint64
+	RecordSize   uint64
+	IPVersion    uint64
+}
+
+// mmdbMaxDepth bounds how deeply maps, arrays and pointers may nest, so
+// that a corrupt file cannot recurse without limit.
+const mmdbMaxDepth = 512
+
+type mmdbDecoder struct {
+	buf   []byte
+	depth int
+}
+
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return nil, 0, errors.New("Unexpected end of database")
+	}
+	if d.depth >= mmdbMaxDepth {
+		return nil, 0, errors.New("Data nested too deeply")
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	ctrl := d.buf[offset]
+	offset++
+	typeNum := uint(ctrl >> 5)
+	if typeNum == 1 {
+		return d.decodePointer(ctrl, offset)
+	}
+	if typeNum == 0 {
+		if offset >= uint(len(d.buf)) {
+			return nil, 0, errors.New("Unexpected end of database")
+		}
+		typeNum = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(d.buf)) {
+			return nil, 0, errors.New("Unexpected end of database")
+		}
+		v := uint(0)
+		for _, b := range d.buf[offset : offset+n] {
+			v = v<<8 | uint(b)
+		}
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+		offset += n
+	}
+	return d.decodeValue(typeNum, size, offset)
+}
+
+func (d *mmdbDecoder) decodePointer(ctrl byte, offset uint) (interface{}, uint, error) {
+	n := uint((ctrl>>3)&0x3) + 1
+	if offset+n > uint(len(d.buf)) {
+		return nil, 0, errors.New("Unexpected end of database")
+	}
+	var p uint
+	if n == 4 {
+		p = 0
+	} else {
+		p = uint(ctrl & 0x7)
+	}
+	for _, b := range d.buf[offset : offset+n] {
+		p = p<<8 | uint(b)
+	}
+	switch n {
+	case 2:
+		p += 2048
+	case 3:
+		p += 526336
+	}
+	// A pointer may not point at another pointer.
+	if p < uint(len(d.buf)) && d.buf[p]>>5 == 1 {
+		return nil, 0, errors.New("Pointer to a pointer")
+	}
+	v, _, err := d.decode(p)
+	return v, offset + n, err
+}
+
+func (d *mmdbDecoder) decodeValue(typeNum uint, size uint, offset uint) (interface{}, uint, error) {
+	// Every map entry or array element takes at least one byte.
+	if (typeNum == 7 || typeNum == 11) && size > uint(len(d.buf))-offset {
+		return nil, 0, errors.New("Unexpected end of database")
+	}
+	switch typeNum {
+	case 7:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("Map key is not a string")
+			}
+			v, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("Unexpected end of database")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+	switch typeNum {
+	case 2:
+		return string(b), next, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, errors.New("Invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case 4:
+		return append([]byte(nil), b...), next, nil
+	case 5, 6, 9:
+		if size > 8 {
+			return nil, 0, errors.New("Invalid unsigned integer size")
+		}
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case 8:
+		if size > 4 {
+			return nil, 0, errors.New("Invalid int32 size")
+		}
+		v := uint32(0)
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int64(int32(v)), next, nil
+	case 10:
+		if size > 16 {
+			return nil, 0, errors.New("Invalid uint128 size")
+		}
+		return new(big.Int).SetBytes(b), next, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, errors.New("Invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	}
+	return nil, 0, errors.New("Unknown data type")
+}
+
+func parseMetadata(tail []byte) (*mmdbMetadata, error) {
+	idx := bytes.LastIndex(tail, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, errors.New("Not a MaxMind DB file")
+	}
+	d := mmdbDecoder{buf: tail[idx+len(mmdbMetadataMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Metadata is not a map")
+	}
+	md := &mmdbMetadata{}
+	md.DatabaseType, _ = m["database_type"].(string)
+	md.BuildEpoch, _ = m["build_epoch"].(uint64)
+	md.NodeCount, _ = m["node_count"].(uint64)
+	md.RecordSize, _ = m["record_size"].(uint64)
+	md.IPVersion, _ = m["ip_version"].(uint64)
+	if md.NodeCount == 0 || md.RecordSize == 0 {
+		return nil, errors.New("Metadata is missing node_count or record_size")
+	}
+	return md, nil
+}
+
+type mmdbReader struct {
+	buf       []byte
+	metadata  *mmdbMetadata
+	nodeBytes uint64
+	data      mmdbDecoder
+	ipv4Start uint64
+}
+
+func openMMDB(data []byte) (*mmdbReader, error) {
+	md, err := metadataFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	r := &mmdbReader{buf: data, metadata: md}
+	switch md.RecordSize {
+	case 24, 28, 32:
+		r.nodeBytes = md.RecordSize / 4
+	default:
+		return nil, errors.New("Unsupported record size")
+	}
+	if md.NodeCount > uint64(len(data))/r.nodeBytes {
+		return nil, errors.New("Search tree larger than the file")
+	}
+	treeSize := md.NodeCount * r.nodeBytes
+	metaStart := uint64(bytes.LastIndex(data, mmdbMetadataMarker))
+	if treeSize+16 > metaStart {
+		return nil, errors.New("Search tree overlaps metadata")
+	}
+	if !bytes.Equal(data[treeSize:treeSize+16], make([]byte, 16)) {
+		return nil, errors.New("Missing data section separator")
+	}
+	r.data = mmdbDecoder{buf: data[treeSize+16 : metaStart]}
+	if md.IPVersion == 6 {
+		node := uint64(0)
+		for i := 0; i < 96 && node < md.NodeCount; i++ {
+			if node, err = r.readNode(node, 0); err != nil {
+				return nil, err
+			}
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+func (r *mmdbReader) readNode(node uint64, bit uint) (uint64, error) {
+	off := node * r.nodeBytes
+	if off+r.nodeBytes > uint64(len(r.buf)) {
+		return 0, errors.New("Search tree node out of range")
+	}
+	b := r.buf[off : off+r.nodeBytes]
+	switch r.metadata.RecordSize {
+	case 24:
+		b = b[bit*3 : bit*3+3]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2]), nil
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6]), nil
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4 : bit*4+4])), nil
+	}
+}
+
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, bool, error) {
+	node := uint64(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.metadata.IPVersion == 4 {
+		return nil, false, nil
+	}
+	bits := uint(len(ip) * 8)
+	var err error
+	for i := uint(0); i < bits && node < r.metadata.NodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-i%8)) & 1
+		if node, err = r.readNode(node, bit); err != nil {
+			return nil, false, err
+		}
+	}
+	if node == r.metadata.NodeCount {
+		return nil, false, nil
+	}
+	if node < r.metadata.NodeCount {
+		return nil, false, errors.New("Search tree does not terminate")
+	}
+	offset := node - r.metadata.NodeCount - 16
+	if offset >= uint64(len(r.data.buf)) {
+		return nil, false, errors.New("Search tree points outside the data section")
+	}
+	v, _, err := r.data.decode(uint(offset))
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+func metadataFromBytes(data []byte) (*mmdbMetadata, error) {
+	start := 0
+	if len(data) > mmdbMetadataMaxSize {
+		start = len(data) - mmdbMetadataMaxSize
+	}
+	return parseMetadata(data[start:])
+}
+
+func metadataFromFile(fn string) (*mmdbMetadata, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	start := fi.Size() - mmdbMetadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, fi.Size()-start)
+	if _, err := f.ReadAt(tail, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return parseMetadata(tail)
+}
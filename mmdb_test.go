@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"testing"
+)
+
+func mmdbCtrl(typeNum int, size int) []byte {
+	var b []byte
+	if typeNum <= 7 {
+		b = []byte{byte(typeNum<<5 | size)}
+	} else {
+		b = []byte{byte(size), byte(typeNum - 7)}
+	}
+	return b
+}
+
+// mmdbEncode encodes strings, uint64s and maps of them, sorting map keys.
+func mmdbEncode(v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(mmdbCtrl(2, len(v)), v...)
+	case uint64:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], v)
+		n := bytes.TrimLeft(b[:], "\x00")
+		return append(mmdbCtrl(9, len(n)), n...)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := mmdbCtrl(7, len(v))
+		for _, k := range keys {
+			out = append(out, mmdbEncode(k)...)
+			out = append(out, mmdbEncode(v[k])...)
+		}
+		return out
+	}
+	panic("cannot encode")
+}
+
+func testMetadata(dbType string, epoch uint64, nodeCount uint64, recordSize uint64) []byte {
+	return append(append([]byte(nil), mmdbMetadataMarker...), mmdbEncode(map[string]interface{}{
+		"database_type": dbType,
+		"build_epoch":   epoch,
+		"node_count":    nodeCount,
+		"record_size":   recordSize,
+		"ip_version":    uint64(4),
+	})...)
+}
+
+// testMMDB returns a valid IPv4 database with one search tree node and no
+// data, so every lookup finds nothing.
+func testMMDB(dbType string, epoch uint64) []byte {
+	data := []byte{0, 0, 1, 0, 0, 1}
+	data = append(data, make([]byte, 16)...)
+	return append(data, testMetadata(dbType, epoch, 1, 24)...)
+}
+
+// testMMDBWith returns a valid IPv4 database in which every address
+// resolves to record.
+func testMMDBWith(dbType string, record map[string]interface{}) []byte {
+	// One node whose records both point at the start of the data
+	// section: node count + 16 + offset 0.
+	data := []byte{0, 0, 17, 0, 0, 17}
+	data = append(data, make([]byte, 16)...)
+	data = append(data, mmdbEncode(record)...)
+	return append(data, testMetadata(dbType, 1000, 1, 24)...)
+}
+
+func metadataWith(body ...byte) []byte {
+	return append(append([]byte(nil), mmdbMetadataMarker...), body...)
+}
+
+func TestCorruptMetadata(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"pointer to itself":   metadataWith(0xe1, 0x20, 0x01),
+		"cycle through a map": metadataWith(0xe1, 0x41, 'a', 0x20, 0x00),
+		"huge map size":       metadataWith(0xff, 0xff, 0xff, 0xff),
+		"huge array size":     metadataWith(0x1f, 0x04, 0xff, 0xff, 0xff),
+	} {
+		if _, err := metadataFromBytes(data); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestOpenMMDB(t *testing.T) {
+	md, err := metadataFromBytes(testMMDB("GeoLite2-City", 1000))
+	if err != nil || md.DatabaseType != "GeoLite2-City" || md.BuildEpoch != 1000 {
+		t.Fatalf("metadata = %+v, %v", md, err)
+	}
+	if _, err := openMMDB(testMMDB("GeoLite2-City", 1000)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenMMDBHugeNodeCount(t *testing.T) {
+	data := append(make([]byte, 8), testMetadata("GeoLite2-City", 1, 1<<61-1, 32)...)
+	if _, err := openMMDB(data); err == nil {
+		t.Fatal("expected an error for a node count larger than the file")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func sourceAddress() (string, string) {
+	if *mirrorUrl != "" {
+		if u, err := url.Parse(*mirrorUrl); err == nil {
+			return "tcp", hostPort(u.Host, u.Scheme)
+		}
+	}
+	if strings.HasPrefix(*sourceHost, unixPrefix) {
+		return "unix", strings.TrimPrefix(*sourceHost, unixPrefix)
+	}
+	return "tcp", hostPort(*sourceHost, *protocol)
+}
+
+func hostPort(host string, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if scheme == "http" {
+		return net.JoinHostPort(host, "80")
+	}
+	return net.JoinHostPort(host, "443")
+}
+
+func waitForNetwork(timeout time.Duration) bool {
+	network, addr := sourceAddress()
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; ; attempt++ {
+		conn, err := net.DialTimeout(network, addr, 5*time.Second)
+		if err == nil {
+			conn.Close()
+			if attempt > 0 {
+				log.Printf("Network is up, %s is reachable", addr)
+			}
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Gave up waiting for %s after %s: %v", addr, timeout.String(), err)
+			return false
+		}
+		if attempt == 0 {
+			log.Printf("Waiting up to %s for %s to become reachable: %v", timeout.String(), addr, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+func pingUrl() (string, error) {
+	if *mirrorUrl == "" {
+		return sourceUrl("/", nil), nil
+	}
+	u, err := mirrorProductUrl("")
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String(), nil
+}
+
+// ping sends an unauthenticated HEAD to the source host and writes one
+// line of key=value pairs describing the connection.
+func ping(w io.Writer) error {
+	u, err := pingUrl()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("HEAD", u, nil)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintf(w, "host=%s error=%q\n", req.URL.Host, err.Error())
+		return err
+	}
+	res.Body.Close()
+	fmt.Fprintf(w, "host=%s status=%d latency=%s", req.URL.Host, res.StatusCode, time.Since(start).Round(time.Millisecond))
+	if res.TLS != nil {
+		fmt.Fprintf(w, " tls=%q", tls.VersionName(res.TLS.Version))
+		if certs := res.TLS.PeerCertificates; len(certs) > 0 {
+			fmt.Fprintf(w, " subject=%q expires=%s", certs[0].Subject.String(), certs[0].NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+	fmt.Fprintln(w)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+)
+
+// preflight makes one authenticated update request for the first product
+// and reports an authError if the server rejects the credentials. Under v2
+// the request is a HEAD so that no database is sent; under legacy only the
+// start of the response is read.
+func preflight(product string) error {
+	if *updateProto == "legacy" {
+		if err := ensureClientIp(); err != nil {
+			return err
+		}
+	}
+	digest := emptyDigest
+	if filename, err := resolveFilename(proto, product); err == nil {
+		if d, err := md5File(path.Join(*directory, filename)); err == nil {
+			digest = d
+		}
+	}
+	req, err := proto.UpdateRequest(product, digest)
+	if err != nil {
+		return err
+	}
+	if *updateProto == "v2" {
+		req.Method = "HEAD"
+	}
+	res, data, err := doRequestWith(req, product, func(res *http.Response) ([]byte, error) {
+		return ioutil.ReadAll(io.LimitReader(res.Body, classifyLimit))
+	})
+	if err != nil {
+		return err
+	}
+	if req.Method == "HEAD" {
+		if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+			return &authError{"Authentication failed: status " + res.Status + " received"}
+		}
+		return nil
+	}
+	if _, err := proto.ParseResponse(res, data); err != nil {
+		if _, ok := err.(*authError); ok {
+			return err
+		}
+		log.Printf("Pre-flight request for %s inconclusive: %v", product, err)
+	}
+	return nil
+}
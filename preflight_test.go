@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLegacyPreflightReadsOnlyAPrefix(t *testing.T) {
+	const size = 256 << 20
+	var sent int64
+	testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == filenamePath {
+			w.Write([]byte("GeoLiteCity.dat"))
+			return
+		}
+		chunk := make([]byte, 64<<10)
+		chunk[0], chunk[1] = 0x1f, 0x8b
+		for atomic.LoadInt64(&sent) < size {
+			n, err := w.Write(chunk)
+			atomic.AddInt64(&sent, int64(n))
+			if err != nil {
+				return
+			}
+			chunk[0], chunk[1] = 0, 0
+		}
+	}))
+	withFlag(t, updateProto, "legacy")
+	old := clientIp
+	clientIp = "192.0.2.1"
+	t.Cleanup(func() { clientIp = old })
+	if err := preflight("533"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&sent); n >= size {
+		t.Fatalf("server sent the whole %d byte body", n)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type progressEvent struct {
+	Event   string    `json:"event"`
+	Product string    `json:"product"`
+	Time    time.Time `json:"time"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	Total   int64     `json:"total,omitempty"`
+	Changed bool      `json:"changed,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	progressOut  io.Writer
+	progressLock sync.Mutex
+)
+
+func openProgress(fd int) {
+	progressOut = os.NewFile(uintptr(fd), "progress")
+}
+
+func emitProgress(ev progressEvent) {
+	if progressOut == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	progressLock.Lock()
+	defer progressLock.Unlock()
+	progressOut.Write(append(data, '\n'))
+}
+
+const progressInterval = 256 * 1024
+
+type progressReader struct {
+	r        io.Reader
+	product  string
+	total    int64
+	read     int64
+	reported int64
+}
+
+func newProgressReader(r io.Reader, product string, total int64) io.Reader {
+	if progressOut == nil {
+		return r
+	}
+	if total < 0 {
+		total = 0
+	}
+	return &progressReader{r: r, product: product, total: total}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.read-p.reported >= progressInterval || (err == io.EOF && p.read > p.reported) {
+		p.reported = p.read
+		emitProgress(progressEvent{Event: "bytes", Product: p.product, Bytes: p.read, Total: p.total})
+	}
+	return n, err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// A Protocol builds the requests used to update a product and interprets
+// the server's responses to them.
+type Protocol interface {
+	FilenameRequest(productId string) (*http.Request, error)
+	UpdateRequest(productId string, oldDigest string) (*http.Request, error)
+	ParseResponse(res *http.Response, body []byte) (*protocolResponse, error)
+}
+
+// protocolResponse is the interpretation of a filename or update response.
+// For an update response with Digest set, Data is known to be complete and
+// no confirming request is needed.
+type protocolResponse struct {
+	Filename string
+	NoUpdate bool
+	Data     []byte
+	Digest   string
+}
+
+var proto Protocol = LegacyProtocol{}
+
+func newProtocol(name string) (Protocol, error) {
+	switch name {
+	case "legacy":
+		return LegacyProtocol{}, nil
+	case "v2":
+		return V2Protocol{}, nil
+	}
+	return nil, errors.New("Unknown update protocol '" + name + "'")
+}
+
+var ErrProductNotFound = errors.New("Product not found")
+
+// An authError reports that the server rejected the configured credentials.
+type authError struct {
+	msg string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+// credentialsGiven reports whether credentials for the named protocol were
+// given explicitly; the default user ID and license key are placeholders.
+func credentialsGiven(name string) bool {
+	if !flagGiven("licensekey") && !*licenseKeyStdin {
+		return false
+	}
+	if name == "v2" {
+		return *accountId != ""
+	}
+	return flagGiven("userid")
+}
+
+// fallbackProtocol returns the other protocol if credentials for it were
+// given.
+func fallbackProtocol() (string, Protocol) {
+	switch {
+	case *updateProto == "legacy" && credentialsGiven("v2"):
+		return "v2", V2Protocol{}
+	case *updateProto == "v2" && credentialsGiven("legacy"):
+		return "legacy", LegacyProtocol{}
+	}
+	return "", nil
+}
+
+const filenamePath = "/app/update_getfilename"
+
+func filenameRequest(productId string) (*http.Request, error) {
+	return http.NewRequest("GET", sourceUrl(filenamePath, map[string]string{"product_id": productId}), nil)
+}
+
+func parseFilenameResponse(res *http.Response, body []byte) (*protocolResponse, error) {
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrProductNotFound
+	}
+	if !isSuccess(res.StatusCode) {
+		return nil, errors.New("Status " + res.Status + " received")
+	}
+	return &protocolResponse{Filename: path.Base(string(body[:]))}, nil
+}
+
+type LegacyProtocol struct{}
+
+func (LegacyProtocol) FilenameRequest(productId string) (*http.Request, error) {
+	return filenameRequest(productId)
+}
+
+func (LegacyProtocol) UpdateRequest(productId string, oldDigest string) (*http.Request, error) {
+	hasher := md5.New()
+	hasher.Write([]byte(*licenseKey))
+	hasher.Write([]byte(clientIp))
+	challenge := hex.EncodeToString(hasher.Sum(nil))
+	return http.NewRequest("GET", sourceUrl("/app/update_secure", map[string]string{
+		"db_md5":        oldDigest,
+		"challenge_md5": challenge,
+		"user_id":       *userId,
+		"edition_id":    productId,
+	}), nil)
+}
+
+func (LegacyProtocol) ParseResponse(res *http.Response, body []byte) (*protocolResponse, error) {
+	if res.Request.URL.Path == filenamePath {
+		return parseFilenameResponse(res, body)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrProductNotFound
+	}
+	if !isSuccess(res.StatusCode) {
+		return nil, errors.New("Status " + res.Status + " received")
+	}
+	if bytes.HasPrefix(body, noUpdatesBody) {
+		return &protocolResponse{NoUpdate: true}, nil
+	}
+	if bytes.HasPrefix(body, []byte("Invalid ")) {
+		return nil, &authError{"Authentication failed: " + string(bytes.TrimSpace(body))}
+	}
+	if !hasArchiveMagic(body) {
+		return nil, errors.New("Not a gzip or zip file")
+	}
+	return &protocolResponse{Data: body}, nil
+}
+
+type V2Protocol struct{}
+
+func (V2Protocol) FilenameRequest(productId string) (*http.Request, error) {
+	return filenameRequest(productId)
+}
+
+func (V2Protocol) UpdateRequest(productId string, oldDigest string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", sourceUrl("/geoip/databases/"+url.PathEscape(productId)+"/update",
+		map[string]string{"db_md5": oldDigest}), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(*accountId, *licenseKey)
+	return req, nil
+}
+
+func (V2Protocol) ParseResponse(res *http.Response, body []byte) (*protocolResponse, error) {
+	if res.Request.URL.Path == filenamePath {
+		return parseFilenameResponse(res, body)
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, ErrProductNotFound
+	}
+	if res.StatusCode == http.StatusNotModified {
+		return &protocolResponse{NoUpdate: true}, nil
+	}
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return nil, &authError{"Authentication failed: status " + res.Status + " received"}
+	}
+	if !isSuccess(res.StatusCode) {
+		return nil, errors.New("Status " + res.Status + " received")
+	}
+	if !hasArchiveMagic(body) {
+		return nil, errors.New("Not a gzip or zip file")
+	}
+	return &protocolResponse{Data: body, Digest: res.Header.Get(*md5Header)}, nil
+}
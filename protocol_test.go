@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFallbackProtocolNeedsGivenCredentials(t *testing.T) {
+	withGivenFlags(t)
+	withFlag(t, updateProto, "v2")
+	if name, _ := fallbackProtocol(); name != "" {
+		t.Fatalf("fell back to %s with only the default user ID and license key", name)
+	}
+	flag.Set("licensekey", "secret")
+	if name, _ := fallbackProtocol(); name != "" {
+		t.Fatalf("fell back to %s with the default user ID", name)
+	}
+	flag.Set("userid", "1234")
+	if name, _ := fallbackProtocol(); name != "legacy" {
+		t.Fatalf("fallback = %q, want legacy", name)
+	}
+	withFlag(t, updateProto, "legacy")
+	if name, _ := fallbackProtocol(); name != "" {
+		t.Fatalf("fell back to %s without --accountid", name)
+	}
+	withFlag(t, accountId, "42")
+	if name, _ := fallbackProtocol(); name != "v2" {
+		t.Fatalf("fallback = %q, want v2", name)
+	}
+}
+
+func TestRunProductReportsFallbackProtocol(t *testing.T) {
+	withFlag(t, updateProto, "v2")
+	r := runProduct("GeoLite2-City", func(p string) (bool, error) {
+		usedProtocolsLock.Lock()
+		usedProtocols[p] = "legacy"
+		usedProtocolsLock.Unlock()
+		return false, errors.New("Authentication failed")
+	})
+	if r.Protocol != "legacy" {
+		t.Fatalf("protocol = %q, want legacy", r.Protocol)
+	}
+	r = runProduct("GeoLite2-City", func(string) (bool, error) { return false, nil })
+	if r.Protocol != "v2" {
+		t.Fatalf("protocol = %q, want v2", r.Protocol)
+	}
+}
+
+func TestV2CustomMD5Header(t *testing.T) {
+	db := testMMDB("GeoLite2-City", 1000)
+	withFlag(t, md5Header, "X-Content-MD5")
+	s := newV2Server(t, map[string][]byte{"GeoLite2-City": db})
+	s.header.Set("X-Database-MD5", md5Hex([]byte("ignored")))
+	if changed, err := getProduct("GeoLite2-City"); err != nil || !changed {
+		t.Fatalf("changed=%v err=%v", changed, err)
+	}
+	// The digest in the custom header means no confirming request.
+	if n := len(s.uris()); n != 2 {
+		t.Fatalf("made %d requests, want a filename and one update request", n)
+	}
+	if err := os.Remove(path.Join(*directory, "GeoLite2-City.mmdb")); err != nil {
+		t.Fatal(err)
+	}
+	s.header.Set("X-Content-MD5", md5Hex([]byte("something else")))
+	if _, err := getProduct("GeoLite2-City"); err == nil || !strings.Contains(err.Error(), "Digest mismatch") {
+		t.Fatalf("err = %v, want a digest mismatch from the custom header", err)
+	}
+}
+
+func TestV2DoesNotAskForClientIp(t *testing.T) {
+	s := newV2Server(t, map[string][]byte{"GeoLite2-City": testMMDB("GeoLite2-City", 1000)})
+	results, err := update([]string{"GeoLite2-City"})
+	if err != nil || results[0].Err != nil {
+		t.Fatalf("update failed: %v %+v", err, results)
+	}
+	for _, u := range s.uris() {
+		if strings.HasPrefix(u, "/app/update_getipaddr") {
+			t.Fatalf("v2 update asked for the client IP: %q", s.uris())
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+func readableBy(fn string, username string) (bool, error) {
+	return false, errors.New("--verify-readable-by is not supported on this platform")
+}
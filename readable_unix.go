@@ -0,0 +1,43 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func readableBy(fn string, username string) (bool, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return false, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, errors.New("Cannot determine owner of " + fn)
+	}
+	mode := fi.Mode().Perm()
+	if u.Uid == "0" {
+		return true, nil
+	}
+	if u.Uid == strconv.FormatUint(uint64(st.Uid), 10) {
+		return mode&0400 != 0, nil
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		gids = []string{u.Gid}
+	}
+	for _, gid := range gids {
+		if gid == strconv.FormatUint(uint64(st.Gid), 10) {
+			return mode&0040 != 0, nil
+		}
+	}
+	return mode&0004 != 0, nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type installedDatabase struct {
+	Path     string
+	Size     int64
+	Metadata *mmdbMetadata
+}
+
+func (db *installedDatabase) BuildTime() time.Time {
+	return time.Unix(int64(db.Metadata.BuildEpoch), 0).UTC()
+}
+
+func (db *installedDatabase) AgeDays(now time.Time) int {
+	return int(now.Sub(db.BuildTime()).Hours() / 24)
+}
+
+func installedDatabases(dir string) ([]*installedDatabase, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var dbs []*installedDatabase
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || !servable(fi.Name()) {
+			continue
+		}
+		fn := path.Join(dir, fi.Name())
+		md, err := metadataFromFile(fn)
+		if err != nil {
+			continue
+		}
+		dbs = append(dbs, &installedDatabase{Path: fn, Size: fi.Size(), Metadata: md})
+	}
+	return dbs, nil
+}
+
+func (db *installedDatabase) Matches(edition string) bool {
+	base := path.Base(db.Path)
+	return db.Metadata.DatabaseType == edition || strings.TrimSuffix(base, path.Ext(base)) == edition
+}
+
+func reportStale(w io.Writer, dir string, maxAges string) (bool, error) {
+	thresholds, err := parseEditionMap(maxAges)
+	if err != nil {
+		return false, err
+	}
+	if len(thresholds) == 0 {
+		return false, errors.New("--report-stale requires --max-age")
+	}
+	dbs, err := installedDatabases(dir)
+	if err != nil {
+		return false, err
+	}
+	editions := make([]string, 0, len(thresholds))
+	for edition := range thresholds {
+		editions = append(editions, edition)
+	}
+	sort.Strings(editions)
+	now := time.Now()
+	stale := false
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EDITION\tSTATUS\tBUILD DATE\tAGE (DAYS)\tMAX AGE")
+	for _, edition := range editions {
+		maxAge, err := parseAge(thresholds[edition])
+		if err != nil {
+			return false, errors.New("Invalid max age for " + edition + ": " + err.Error())
+		}
+		var found *installedDatabase
+		for _, db := range dbs {
+			if db.Matches(edition) && (found == nil || db.Metadata.BuildEpoch > found.Metadata.BuildEpoch) {
+				found = db
+			}
+		}
+		if found == nil {
+			stale = true
+			fmt.Fprintf(tw, "%s\tMISSING\t-\t-\t%s\n", edition, thresholds[edition])
+			continue
+		}
+		status := "OK"
+		if now.Sub(found.BuildTime()) > maxAge {
+			status = "STALE"
+			stale = true
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", edition, status,
+			found.BuildTime().Format("2006-01-02"), found.AgeDays(now), thresholds[edition])
+	}
+	return stale, tw.Flush()
+}
+
+func reportBuildAges(w io.Writer, dir string) error {
+	dbs, err := installedDatabases(dir)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(dbs, func(i, j int) bool {
+		return dbs[i].Metadata.BuildEpoch < dbs[j].Metadata.BuildEpoch
+	})
+	now := time.Now()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "EDITION\tBUILD DATE\tAGE (DAYS)\tSIZE\tFILE")
+	for _, db := range dbs {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n",
+			db.Metadata.DatabaseType,
+			db.BuildTime().Format("2006-01-02"),
+			db.AgeDays(now),
+			db.Size,
+			path.Base(db.Path))
+	}
+	return tw.Flush()
+}
+
+type verifyResult struct {
+	File         string `json:"file"`
+	Valid        bool   `json:"valid"`
+	DatabaseType string `json:"database_type,omitempty"`
+	BuildDate    string `json:"build_date,omitempty"`
+	Size         int64  `json:"size"`
+	Error        string `json:"error,omitempty"`
+}
+
+func verifyInstalled(dir string) ([]verifyResult, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var results []verifyResult
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() || path.Ext(fi.Name()) != ".mmdb" {
+			continue
+		}
+		vr := verifyResult{File: fi.Name(), Size: fi.Size()}
+		data, err := ioutil.ReadFile(path.Join(dir, fi.Name()))
+		if err == nil {
+			var md *mmdbMetadata
+			if md, err = metadataFromBytes(data); err == nil {
+				vr.DatabaseType = md.DatabaseType
+				vr.BuildDate = time.Unix(int64(md.BuildEpoch), 0).UTC().Format("2006-01-02")
+				err = verifyDatabase(data)
+			}
+		}
+		if err != nil {
+			vr.Error = err.Error()
+		} else {
+			vr.Valid = true
+		}
+		results = append(results, vr)
+	}
+	return results, nil
+}
+
+// sweep re-verifies every database in dir after a run, in case one was
+// changed underneath it, and fails if any is invalid.
+func sweep(dir string) error {
+	results, err := verifyInstalled(dir)
+	if err != nil {
+		log.Printf("Cannot sweep %s: %v", dir, err)
+		return err
+	}
+	invalid := 0
+	for _, vr := range results {
+		if !vr.Valid {
+			invalid++
+			log.Printf("WARNING: post-run sweep found %s invalid: %s", vr.File, vr.Error)
+		}
+	}
+	log.Printf("Post-run sweep checked %d databases in %s, %d invalid", len(results), dir, invalid)
+	if invalid > 0 {
+		return errors.New("Post-run sweep found " + strconv.Itoa(invalid) + " invalid databases")
+	}
+	return nil
+}
+
+func reportVerify(w io.Writer, dir string, format string) (bool, error) {
+	if format != "text" && format != "json" {
+		return false, errors.New("Unknown format '" + format + "', expected text or json")
+	}
+	results, err := verifyInstalled(dir)
+	if err != nil {
+		return false, err
+	}
+	ok := true
+	for _, vr := range results {
+		ok = ok && vr.Valid
+	}
+	if format == "json" {
+		if results == nil {
+			results = []verifyResult{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return ok, enc.Encode(results)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tSTATUS\tEDITION\tBUILD DATE\tSIZE\tERROR")
+	for _, vr := range results {
+		status := "OK"
+		if !vr.Valid {
+			status = "INVALID"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", vr.File, status,
+			dash(vr.DatabaseType), dash(vr.BuildDate), vr.Size, dash(vr.Error))
+	}
+	return ok, tw.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+type manifestEntry struct {
+	Path      string `json:"path"`
+	Edition   string `json:"edition"`
+	BuildDate string `json:"build_date"`
+	Size      int64  `json:"size"`
+	MD5       string `json:"md5"`
+	SHA256    string `json:"sha256"`
+}
+
+func fileDigests(fn string) (string, string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	m, s := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(m, s), f); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(m.Sum(nil)), hex.EncodeToString(s.Sum(nil)), nil
+}
+
+func writeManifest(w io.Writer, dir string) error {
+	dbs, err := installedDatabases(dir)
+	if err != nil {
+		return err
+	}
+	entries := []manifestEntry{}
+	for _, db := range dbs {
+		md5sum, sha256sum, err := fileDigests(db.Path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{
+			Path:      db.Path,
+			Edition:   db.Metadata.DatabaseType,
+			BuildDate: db.BuildTime().Format(time.RFC3339),
+			Size:      db.Size,
+			MD5:       md5sum,
+			SHA256:    sha256sum,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+func exportManifest(fn string) error {
+	if fn == "-" {
+		return writeManifest(os.Stdout, *directory)
+	}
+	var b bytes.Buffer
+	if err := writeManifest(&b, *directory); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
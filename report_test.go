@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestInstalledDatabasesSkipsLeftovers(t *testing.T) {
+	dir := t.TempDir()
+	db := testMMDB("GeoLite2-City", 1000)
+	for _, name := range []string{
+		"GeoLite2-City.mmdb",
+		"GeoLite2-City.mmdb.failed",
+		"GeoLite2-City.mmdb.last-good",
+		"GeoLite2-City.mmdb.123.abc.tmp",
+		"GeoLite2-City.mmdb.meta",
+		".spool-123",
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, name), db, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dbs, err := installedDatabases(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbs) != 1 || path.Base(dbs[0].Path) != "GeoLite2-City.mmdb" {
+		for _, db := range dbs {
+			t.Log(db.Path)
+		}
+		t.Fatalf("found %d databases, want only GeoLite2-City.mmdb", len(dbs))
+	}
+}
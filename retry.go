@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func checkRetryJitter(s string) error {
+	switch s {
+	case "full", "equal", "none":
+		return nil
+	}
+	return errors.New("Unknown --retry-jitter '" + s + "', expected full, equal or none")
+}
+
+// backoff returns the wait before retry number attempt (counting from 0).
+// With d = --retry-base * 2^attempt, "none" waits d, "full" a random time
+// in [0, d] and "equal" d/2 plus a random time in [0, d/2].
+func backoff(attempt int) time.Duration {
+	d := *retryBase << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
+	switch *retryJitter {
+	case "full":
+		return time.Duration(randInt64(int64(d) + 1))
+	case "equal":
+		return d/2 + time.Duration(randInt64(int64(d/2)+1))
+	}
+	return d
+}
+
+func retryable(res *http.Response, err error) bool {
+	return err != nil || res.StatusCode >= 500
+}
+
+var (
+	retryCounts     = make(map[string]int)
+	retryCountsLock sync.Mutex
+)
+
+// takeRetries returns and resets the number of retries made for productId
+// since the last call.
+func takeRetries(productId string) int {
+	retryCountsLock.Lock()
+	defer retryCountsLock.Unlock()
+	n := retryCounts[productId]
+	delete(retryCounts, productId)
+	return n
+}
+
+// doWithRetries counts its retries against productId, unless it is empty.
+func doWithRetries(req *http.Request, productId string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := client.Do(req.WithContext(runCtx))
+		if attempt >= *retries || !retryable(res, err) || runCtx.Err() != nil {
+			return res, err
+		}
+		if err == nil {
+			log.Printf("Request to %s://%s returned %s", req.URL.Scheme, req.URL.Host, res.Status)
+			res.Body.Close()
+		} else {
+			log.Printf("Request to %s://%s failed: %v", req.URL.Scheme, req.URL.Host, err)
+		}
+		if productId != "" {
+			retryCountsLock.Lock()
+			retryCounts[productId]++
+			retryCountsLock.Unlock()
+		}
+		wait := backoff(attempt)
+		log.Printf("Retrying in %s (%d of %d)", wait, attempt+1, *retries)
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffRanges(t *testing.T) {
+	old := *retryBase
+	*retryBase = 100 * time.Millisecond
+	t.Cleanup(func() { *retryBase = old })
+	for _, c := range []struct {
+		jitter   string
+		min, max time.Duration
+	}{
+		{"none", 400 * time.Millisecond, 400 * time.Millisecond},
+		{"full", 0, 400 * time.Millisecond},
+		{"equal", 200 * time.Millisecond, 400 * time.Millisecond},
+	} {
+		withFlag(t, retryJitter, c.jitter)
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			d := backoff(2)
+			if d < c.min || d > c.max {
+				t.Fatalf("%s: backoff(2) = %s, want between %s and %s", c.jitter, d, c.min, c.max)
+			}
+			seen[d] = true
+		}
+		if c.min != c.max && len(seen) < 2 {
+			t.Fatalf("%s: backoff(2) is always %s", c.jitter, c.min)
+		}
+	}
+}
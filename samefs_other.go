@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "os"
+
+func sameFilesystem(a string, b string) (same bool, known bool, err error) {
+	if _, err := os.Stat(a); err != nil {
+		return false, false, err
+	}
+	return false, false, nil
+}
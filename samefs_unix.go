@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+func sameFilesystem(a string, b string) (same bool, known bool, err error) {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false, false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false, false, err
+	}
+	sa, ok := fa.Sys().(*syscall.Stat_t)
+	sb, ok2 := fb.Sys().(*syscall.Stat_t)
+	if !ok || !ok2 {
+		return false, false, nil
+	}
+	return sa.Dev == sb.Dev, true, nil
+}
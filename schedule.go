@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+func productHost(productId string) string {
+	if *mirrorUrl != "" {
+		if u, err := mirrorProductUrl(productId); err == nil {
+			return u.Host
+		}
+	}
+	return urlHost()
+}
+
+type circuitBreaker struct {
+	lock        sync.Mutex
+	threshold   int
+	consecutive int
+	open        bool
+}
+
+var breaker circuitBreaker
+
+func (b *circuitBreaker) reset(threshold int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.threshold = threshold
+	b.consecutive = 0
+	b.open = false
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.open
+}
+
+func (b *circuitBreaker) record(err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+	if b.threshold > 0 && b.consecutive >= b.threshold && !b.open {
+		log.Printf("Circuit breaker open after %d consecutive failures, failing remaining products", b.consecutive)
+		b.open = true
+	}
+}
+
+type startThrottle struct {
+	lock  sync.Mutex
+	delay time.Duration
+	last  time.Time
+}
+
+func (t *startThrottle) wait() {
+	if t.delay <= 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.last.IsZero() {
+		if d := t.delay - time.Since(t.last); d > 0 {
+			time.Sleep(d)
+		}
+	}
+	t.last = time.Now()
+}
+
+func productProtocol() string {
+	if *mirrorUrl != "" {
+		return "mirror"
+	}
+	return *updateProto
+}
+
+func productGone(productId string, err error) (bool, error) {
+	switch *onProductGone {
+	case "skip":
+		log.Printf("Product %s not found on the server, skipping", productId)
+		return false, nil
+	case "remove":
+		return removeGone(productId)
+	}
+	return false, err
+}
+
+func removeGone(productId string) (bool, error) {
+	dbs, err := installedDatabases(*directory)
+	if err != nil {
+		return false, err
+	}
+	removed := false
+	for _, db := range dbs {
+		if !db.Matches(productId) {
+			continue
+		}
+		log.Printf("Product %s not found on the server, removing %s", productId, db.Path)
+		if err := os.Remove(db.Path); err != nil {
+			return false, err
+		}
+		os.Remove(sidecarPath(db.Path))
+		os.Remove(lastGoodPath(db.Path))
+		removed = true
+	}
+	if !removed {
+		log.Printf("Product %s not found on the server and not installed", productId)
+	}
+	return removed, nil
+}
+
+func runProduct(p string, get func(string) (bool, error)) productResult {
+	r := productResult{ProductId: p, Host: productHost(p), Protocol: productProtocol()}
+	if breaker.isOpen() {
+		r.Err = errors.New("Circuit breaker open")
+		emitProgress(progressEvent{Event: "error", Product: p, Error: r.Err.Error()})
+		return r
+	}
+	emitProgress(progressEvent{Event: "start", Product: p})
+	started := time.Now()
+	takeRetries(p)
+	takeUsedProtocol(p)
+	takeHookError(p)
+	r.Changed, r.Err = get(p)
+	r.Retries = takeRetries(p)
+	if name := takeUsedProtocol(p); name != "" {
+		r.Protocol = name
+	}
+	r.HookErr = takeHookError(p)
+	if r.Err == ErrProductNotFound {
+		r.Changed, r.Err = productGone(p, r.Err)
+	}
+	r.Duration = time.Since(started)
+	if r.Err != nil {
+		emitProgress(progressEvent{Event: "error", Product: p, Error: r.Err.Error()})
+	} else {
+		emitProgress(progressEvent{Event: "done", Product: p, Changed: r.Changed})
+	}
+	breaker.record(r.Err)
+	return r
+}
+
+func runProducts(products []string, get func(string) (bool, error)) []productResult {
+	results := make([]productResult, len(products))
+	breaker.reset(*breakerThreshold)
+	workers := *concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	hostSlots := make(map[string]chan struct{})
+	throttle := &startThrottle{delay: *productDelay}
+	var wg sync.WaitGroup
+	for i, p := range products {
+		host := productHost(p)
+		if _, ok := hostSlots[host]; !ok && *maxPerHost > 0 {
+			hostSlots[host] = make(chan struct{}, *maxPerHost)
+		}
+		wg.Add(1)
+		go func(i int, p string, hostSlot chan struct{}) {
+			defer wg.Done()
+			if hostSlot != nil {
+				hostSlot <- struct{}{}
+				defer func() { <-hostSlot }()
+			}
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			throttle.wait()
+			results[i] = runProduct(p, get)
+			r := results[i]
+			recordOutcome(p, r.outcome())
+			if r.Err != nil && workers > 1 {
+				return
+			}
+			if r.Err != nil {
+				logFailure(r)
+			} else {
+				log.Printf("Product %s served by host=%s protocol=%s retries=%d", p, r.Host, r.Protocol, r.Retries)
+				productDone(p)
+			}
+		}(i, p, hostSlots[host])
+		if workers == 1 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+	if workers > 1 {
+		logFailures(results)
+	}
+	return results
+}
+
+func logFailure(r productResult) {
+	log.Printf("Failed to update product %s outcome=failed host=%s protocol=%s retries=%d error=%q", r.ProductId, r.Host, r.Protocol, r.Retries, r.Err.Error())
+}
+
+// errorKey groups errors with the same root cause. Path errors differ only
+// in the file name when a shared directory is at fault, so they are keyed
+// on the directory instead.
+func errorKey(err error) string {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Op + " " + path.Dir(pe.Path) + ": " + pe.Err.Error()
+	}
+	return err.Error()
+}
+
+func logFailures(results []productResult) {
+	groups := make(map[string][]productResult)
+	var keys []string
+	for _, r := range results {
+		if r.Err == nil {
+			continue
+		}
+		k := errorKey(r.Err)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], r)
+	}
+	for _, k := range keys {
+		g := groups[k]
+		if len(g) == 1 {
+			logFailure(g[0])
+			continue
+		}
+		ids := make([]string, len(g))
+		for i, r := range g {
+			ids[i] = r.ProductId
+		}
+		log.Printf("Failed to update %d products %s outcome=failed error=%q", len(g), strings.Join(ids, ","), g[0].Err.Error())
+	}
+}
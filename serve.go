@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+type mirrorServer struct {
+	dir   string
+	lock  sync.Mutex
+	etags map[string]etagEntry
+}
+
+func servable(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return false
+	}
+	for _, ext := range []string{".tmp", ".meta", ".last-good", ".failed"} {
+		if strings.HasSuffix(name, ext) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *mirrorServer) etag(name string, f *os.File, fi os.FileInfo) (string, error) {
+	s.lock.Lock()
+	e, ok := s.etags[name]
+	s.lock.Unlock()
+	if ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+		return e.etag, nil
+	}
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	e = etagEntry{size: fi.Size(), modTime: fi.ModTime(), etag: `"` + hex.EncodeToString(hasher.Sum(nil)) + `"`}
+	s.lock.Lock()
+	s.etags[name] = e
+	s.lock.Unlock()
+	return e.etag, nil
+}
+
+func (s *mirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if !servable(name) {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(path.Join(s.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	etag, err := s.etag(name, f, fi)
+	if err != nil {
+		log.Printf("Cannot read %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+func serveMirror(addr string, dir string) error {
+	log.Printf("Serving %s on %s", dir, addr)
+	return http.ListenAndServe(addr, &mirrorServer{dir: dir, etags: make(map[string]etagEntry)})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+var signingKey crypto.PublicKey
+
+func loadPublicKey(fn string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM block found in " + fn)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *rsa.PublicKey:
+		return key, nil
+	}
+	return nil, errors.New("Public key in " + fn + " is neither ed25519 nor RSA")
+}
+
+func fetchSignature(productId string) ([]byte, error) {
+	u := strings.Replace(*signatureUrl, "{edition}", url.PathEscape(productId), -1)
+	res, data, err := fetch(u, productId)
+	if err != nil {
+		return nil, err
+	}
+	if !isSuccess(res.StatusCode) {
+		return nil, errors.New("Signature download status " + res.Status + " received")
+	}
+	if sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err == nil {
+		return sig, nil
+	}
+	return data, nil
+}
+
+func checkSignature(productId string, data []byte) error {
+	if signingKey == nil {
+		return nil
+	}
+	sig, err := fetchSignature(productId)
+	if err != nil {
+		return err
+	}
+	switch key := signingKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, sig) {
+			return errors.New("Signature mismatch")
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return errors.New("Signature mismatch: " + err.Error())
+		}
+	}
+	return nil
+}
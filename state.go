@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type runState struct {
+	CycleStart time.Time         `json:"cycle_start"`
+	Completed  []string          `json:"completed,omitempty"`
+	Products   []string          `json:"products,omitempty"`
+	NextIndex  int               `json:"next_index,omitempty"`
+	Statuses   map[string][]int  `json:"statuses,omitempty"`
+	Outcomes   map[string]string `json:"outcomes,omitempty"`
+	Sizes      map[string]int64  `json:"sizes,omitempty"`
+}
+
+const statusHistoryLen = 10
+
+var (
+	state       runState
+	stateLoaded bool
+	stateLock   sync.Mutex
+)
+
+func loadState() runState {
+	var st runState
+	data, err := ioutil.ReadFile(*stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Cannot read state file %s: %v", *stateFile, err)
+		}
+		return st
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		log.Printf("Ignoring unreadable state file %s: %v", *stateFile, err)
+		return runState{}
+	}
+	return st
+}
+
+// saveState writes the state file, except in a --dry-run, which must
+// leave no trace.
+func saveState() {
+	if *dryRun {
+		return
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Cannot encode state: %v", err)
+		return
+	}
+	tmp := *stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err == nil {
+		err = os.Rename(tmp, *stateFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Cannot write state file %s: %v", *stateFile, err)
+	}
+}
+
+func selectProducts(products []string) []string {
+	n := *maxPerRun
+	if n <= 0 || n >= len(products) {
+		return products
+	}
+	if *interval <= 0 {
+		log.Printf("Skipping %d of %d products because of --max-products-per-run: %s",
+			len(products)-n, len(products), strings.Join(products[n:], ","))
+		return products[:n]
+	}
+	start := state.NextIndex % len(products)
+	selected := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		selected = append(selected, products[(start+i)%len(products)])
+	}
+	state.NextIndex = (start + n) % len(products)
+	return selected
+}
+
+func startCycle(products []string, resume bool) []string {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if *stateFile != "" {
+		state = loadState()
+		stateLoaded = true
+	}
+	if *retryFailed {
+		var failed []string
+		for _, p := range products {
+			if state.Outcomes[p] == "failed" {
+				failed = append(failed, p)
+			}
+		}
+		products = failed
+	}
+	if *stateFile == "" || *interval <= 0 {
+		return selectProducts(products)
+	}
+	if resume && !state.CycleStart.IsZero() && time.Now().Before(state.CycleStart.Add(*interval)) {
+		done := make(map[string]bool)
+		for _, p := range state.Completed {
+			done[p] = true
+		}
+		chosen := make(map[string]bool)
+		for _, p := range state.Products {
+			chosen[p] = true
+		}
+		var cycleProducts, remaining []string
+		for _, p := range products {
+			if len(chosen) > 0 && !chosen[p] {
+				continue
+			}
+			cycleProducts = append(cycleProducts, p)
+			if !done[p] {
+				remaining = append(remaining, p)
+			}
+		}
+		log.Printf("Resuming cycle started at %s: %d of %d products remaining",
+			state.CycleStart.Format(time.RFC3339), len(remaining), len(cycleProducts))
+		return remaining
+	}
+	state.CycleStart = time.Now().UTC()
+	state.Completed = nil
+	state.Products = nil
+	selected := selectProducts(products)
+	if len(selected) < len(products) {
+		state.Products = selected
+	}
+	saveState()
+	return selected
+}
+
+func productDone(productId string) {
+	if *stateFile == "" || *interval <= 0 {
+		return
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	state.Completed = append(state.Completed, productId)
+	saveState()
+}
+
+func recordStatus(productId string, code int) {
+	if *stateFile == "" || *dryRun {
+		return
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if !stateLoaded {
+		state = loadState()
+		stateLoaded = true
+	}
+	if state.Statuses == nil {
+		state.Statuses = make(map[string][]int)
+	}
+	codes := append(state.Statuses[productId], code)
+	if len(codes) > statusHistoryLen {
+		codes = codes[len(codes)-statusHistoryLen:]
+	}
+	state.Statuses[productId] = codes
+	saveState()
+}
+
+func recordOutcome(productId string, outcome string) {
+	if *stateFile == "" {
+		return
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if !stateLoaded {
+		state = loadState()
+		stateLoaded = true
+	}
+	if state.Outcomes == nil {
+		state.Outcomes = make(map[string]string)
+	}
+	state.Outcomes[productId] = outcome
+	saveState()
+}
+
+func recordSize(productId string, size int64) {
+	if *stateFile == "" {
+		return
+	}
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if !stateLoaded {
+		state = loadState()
+		stateLoaded = true
+	}
+	if state.Sizes == nil {
+		state.Sizes = make(map[string]int64)
+	}
+	state.Sizes[productId] = size
+	saveState()
+}
+
+// orderProducts sorts products by the size last installed for each, as
+// --order-by asks. Products of unknown size keep their order and go last.
+func orderProducts(products []string) []string {
+	if *orderBy == "config" {
+		return products
+	}
+	stateLock.Lock()
+	sizes := state.Sizes
+	stateLock.Unlock()
+	ordered := append([]string(nil), products...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, aok := sizes[ordered[i]]
+		b, bok := sizes[ordered[j]]
+		if !aok || !bok {
+			return aok && !bok
+		}
+		if *orderBy == "size-desc" {
+			return a > b
+		}
+		return a < b
+	})
+	return ordered
+}
+
+func reportStatus(w io.Writer, history bool) error {
+	if *stateFile == "" {
+		return errors.New("status requires --state-file")
+	}
+	st := loadState()
+	if st.CycleStart.IsZero() {
+		fmt.Fprintln(w, "No cycle recorded")
+	} else {
+		fmt.Fprintf(w, "Cycle started %s, %d products completed\n", st.CycleStart.Format(time.RFC3339), len(st.Completed))
+	}
+	if !history {
+		return nil
+	}
+	products := make([]string, 0, len(st.Statuses))
+	for p := range st.Statuses {
+		products = append(products, p)
+	}
+	sort.Strings(products)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "PRODUCT\tHTTP STATUSES (OLDEST FIRST)")
+	for _, p := range products {
+		codes := make([]string, 0, len(st.Statuses[p]))
+		for _, c := range st.Statuses[p] {
+			if c == 0 {
+				codes = append(codes, "error")
+			} else {
+				codes = append(codes, strconv.Itoa(c))
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", p, strings.Join(codes, " "))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+// withState points --state-file at a fresh file and forgets any state
+// loaded so far.
+func withState(t *testing.T) {
+	withFlag(t, stateFile, path.Join(t.TempDir(), "state.json"))
+	reset := func() {
+		stateLock.Lock()
+		state, stateLoaded = runState{}, false
+		stateLock.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestClientIpFailureRecordsOutcomes(t *testing.T) {
+	testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	withFlag(t, updateProto, "legacy")
+	withState(t)
+	products := []string{"506", "517"}
+	if _, err := update(products); err == nil {
+		t.Fatal("expected the client IP lookup to fail")
+	}
+	withBool(t, retryFailed, true)
+	if got := startCycle(products, false); !reflect.DeepEqual(got, products) {
+		t.Fatalf("--retry-failed would retry %q, want %q", got, products)
+	}
+}
+
+func TestDryRunLeavesStateAlone(t *testing.T) {
+	testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("GeoLiteCity.dat"))
+	}))
+	withState(t)
+	withBool(t, dryRun, true)
+	if err := reportDryRun(ioutil.Discard, []string{"533"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(*stateFile); !os.IsNotExist(err) {
+		t.Fatalf("state file written during --dry-run: %v", err)
+	}
+	if len(state.Statuses) != 0 {
+		t.Fatalf("statuses recorded during --dry-run: %v", state.Statuses)
+	}
+}
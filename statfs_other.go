@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+func freeInodes(dir string) (free uint64, supported bool, err error) {
+	return 0, false, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type productStatus struct {
+	Product  string  `json:"product"`
+	Outcome  string  `json:"outcome"`
+	Host     string  `json:"host"`
+	Protocol string  `json:"protocol"`
+	Duration float64 `json:"duration_seconds"`
+	Retries  int     `json:"retries"`
+	Error    string  `json:"error,omitempty"`
+	HookErr  string  `json:"hook_error,omitempty"`
+}
+
+type runStatus struct {
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Products []productStatus `json:"products"`
+}
+
+func (r productResult) outcome() string {
+	switch {
+	case r.Err != nil:
+		return "failed"
+	case r.Changed:
+		return "updated"
+	}
+	return "unchanged"
+}
+
+func writeStatus(fn string, results []productResult, started time.Time) error {
+	st := runStatus{Started: started, Finished: time.Now(), Products: []productStatus{}}
+	for _, r := range results {
+		ps := productStatus{
+			Product:  r.ProductId,
+			Outcome:  r.outcome(),
+			Host:     r.Host,
+			Protocol: r.Protocol,
+			Duration: r.Duration.Seconds(),
+			Retries:  r.Retries,
+		}
+		if r.Err != nil {
+			ps.Error = r.Err.Error()
+		}
+		if r.HookErr != nil {
+			ps.HookErr = r.HookErr.Error()
+		}
+		st.Products = append(st.Products, ps)
+	}
+	var data []byte
+	var err error
+	if *statusFormat == "yaml" {
+		data = st.yaml()
+	} else if data, err = json.MarshalIndent(st, "", "  "); err != nil {
+		return err
+	} else {
+		data = append(data, '\n')
+	}
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// yamlString quotes s as a YAML double-quoted scalar, whose escapes are a
+// superset of JSON's.
+func yamlString(s string) string {
+	q, _ := json.Marshal(s)
+	return string(q)
+}
+
+// yaml encodes st with the same keys as its JSON form.
+func (st runStatus) yaml() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "started: %s\n", yamlString(st.Started.Format(time.RFC3339Nano)))
+	fmt.Fprintf(&b, "finished: %s\n", yamlString(st.Finished.Format(time.RFC3339Nano)))
+	if len(st.Products) == 0 {
+		b.WriteString("products: []\n")
+		return b.Bytes()
+	}
+	b.WriteString("products:\n")
+	for _, ps := range st.Products {
+		fmt.Fprintf(&b, "  - product: %s\n", yamlString(ps.Product))
+		fmt.Fprintf(&b, "    outcome: %s\n", yamlString(ps.Outcome))
+		fmt.Fprintf(&b, "    host: %s\n", yamlString(ps.Host))
+		fmt.Fprintf(&b, "    protocol: %s\n", yamlString(ps.Protocol))
+		fmt.Fprintf(&b, "    duration_seconds: %s\n", strconv.FormatFloat(ps.Duration, 'f', -1, 64))
+		fmt.Fprintf(&b, "    retries: %d\n", ps.Retries)
+		if ps.Error != "" {
+			fmt.Fprintf(&b, "    error: %s\n", yamlString(ps.Error))
+		}
+		if ps.HookErr != "" {
+			fmt.Fprintf(&b, "    hook_error: %s\n", yamlString(ps.HookErr))
+		}
+	}
+	return b.Bytes()
+}
+
+type cycleReport struct {
+	Time      time.Time `json:"time"`
+	Duration  float64   `json:"duration_seconds"`
+	Updated   int       `json:"updated"`
+	Unchanged int       `json:"unchanged"`
+	Failed    int       `json:"failed"`
+	Errors    []string  `json:"errors,omitempty"`
+}
+
+func writeCycleReport(w io.Writer, format string, results []productResult, started time.Time, err error) error {
+	cr := cycleReport{Time: time.Now().UTC(), Duration: time.Since(started).Seconds()}
+	for _, r := range results {
+		switch r.outcome() {
+		case "updated":
+			cr.Updated++
+		case "unchanged":
+			cr.Unchanged++
+		default:
+			cr.Failed++
+			cr.Errors = append(cr.Errors, r.ProductId+": "+r.Err.Error())
+		}
+	}
+	if err != nil && cr.Failed == 0 {
+		cr.Errors = append(cr.Errors, err.Error())
+	}
+	if format == "json" {
+		data, err := json.Marshal(cr)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s cycle duration=%.3fs updated=%d unchanged=%d failed=%d errors=%q\n",
+		cr.Time.Format(time.RFC3339), cr.Duration, cr.Updated, cr.Unchanged, cr.Failed, strings.Join(cr.Errors, "; "))
+	return err
+}
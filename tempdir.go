@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"syscall"
+)
+
+// crossDevice is set at startup when --temp-dir is known to be on a
+// different filesystem from --directory, so that renames are not tried.
+var crossDevice bool
+
+func checkTempDir() error {
+	same, known, err := sameFilesystem(*tempDir, *directory)
+	if err != nil {
+		return err
+	}
+	if !known || same {
+		return nil
+	}
+	if *requireSameFs {
+		return errors.New("--temp-dir " + *tempDir + " is not on the same filesystem as --directory " + *directory)
+	}
+	log.Printf("WARNING: --temp-dir %s is not on the same filesystem as %s; databases will be copied into place", *tempDir, *directory)
+	crossDevice = true
+	return nil
+}
+
+// moveFile renames src to dst, or copies it next to dst and renames the
+// copy when they are on different filesystems. src is removed only on
+// success.
+func moveFile(src string, dst string) error {
+	if !crossDevice {
+		err := os.Rename(src, dst)
+		if le, ok := err.(*os.LinkError); !ok || le.Err != syscall.EXDEV {
+			return err
+		}
+		log.Printf("Cannot rename %s to %s across filesystems, copying instead", src, dst)
+	}
+	local := dst + tempSuffix()
+	trackTemp(local)
+	defer releaseTemp(local)
+	if err := copyFile(src, local); err != nil {
+		os.Remove(local)
+		return err
+	}
+	if err := os.Rename(local, dst); err != nil {
+		os.Remove(local)
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func newListFlag(name string, usage string) *listFlag {
+	l := &listFlag{}
+	flag.Var(l, name, usage)
+	return l
+}
+
+type expectation struct {
+	ip    net.IP
+	value string
+}
+
+func parseExpectations() ([]expectation, error) {
+	var exps []expectation
+	for _, e := range *verifyExpect {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.New("Expected address=value, got '" + e + "'")
+		}
+		ip := net.ParseIP(strings.TrimSpace(kv[0]))
+		if ip == nil {
+			return nil, errors.New("Invalid address in --verify-expect '" + e + "'")
+		}
+		exps = append(exps, expectation{ip: ip, value: strings.TrimSpace(kv[1])})
+	}
+	return exps, nil
+}
+
+func lookupField(v interface{}, keys ...string) interface{} {
+	for _, k := range keys {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// checkExpectations looks up each --verify-expect address. ASN editions are
+// compared on the AS number (a value such as 13335 or AS13335), other
+// editions on the country ISO code; values of the wrong form for the
+// edition are skipped.
+func checkExpectations(md *mmdbMetadata, r *mmdbReader) error {
+	exps, err := parseExpectations()
+	if err != nil {
+		return err
+	}
+	asn := strings.Contains(md.DatabaseType, "ASN")
+	for _, e := range exps {
+		// An ASN is digits, optionally after "AS"; anything else, including
+		// the country code AS, is a country.
+		want := strings.ToUpper(e.value)
+		number := strings.TrimPrefix(want, "AS")
+		_, numErr := strconv.ParseUint(number, 10, 32)
+		if numErr == nil {
+			want = number
+		}
+		if asn != (numErr == nil) {
+			continue
+		}
+		v, found, err := r.lookup(e.ip)
+		if err != nil {
+			return errors.New("Lookup of " + e.ip.String() + " failed: " + err.Error())
+		}
+		got := ""
+		if found && asn {
+			if n, ok := lookupField(v, "autonomous_system_number").(uint64); ok {
+				got = strconv.FormatUint(n, 10)
+			}
+		} else if found {
+			got, _ = lookupField(v, "country", "iso_code").(string)
+		}
+		if !strings.EqualFold(got, want) {
+			return errors.New("Expected " + e.ip.String() + " to resolve to " + e.value + ", got '" + got + "'")
+		}
+	}
+	return nil
+}
+
+func verifyAddresses() ([]net.IP, error) {
+	var ips []net.IP
+	for _, a := range splitList(*verifyAddress) {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, errors.New("Invalid verification address '" + a + "'")
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseEditionMap(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range splitList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, errors.New("Expected edition=value, got '" + item + "'")
+		}
+		m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return m, nil
+}
+
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch u := strings.ToUpper(s); {
+	case strings.HasSuffix(u, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(u, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(u, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+func checkMinSize(productId string, data []byte) error {
+	sizes, err := parseEditionMap(*minSize)
+	if err != nil {
+		return err
+	}
+	s, ok := sizes[productId]
+	if !ok {
+		return nil
+	}
+	min, err := parseSize(s)
+	if err != nil {
+		return errors.New("Invalid minimum size for " + productId + ": " + err.Error())
+	}
+	if int64(len(data)) < min {
+		return errors.New("Database too small: got " + strconv.Itoa(len(data)) + " bytes, need at least " + strconv.FormatInt(min, 10))
+	}
+	return nil
+}
+
+func checkResponseSize(productId string, res *http.Response) error {
+	if res.ContentLength < 0 {
+		return nil
+	}
+	sizes, err := parseEditionMap(*minResponseSize)
+	if err != nil {
+		return err
+	}
+	s, ok := sizes[productId]
+	if !ok {
+		return nil
+	}
+	min, err := parseSize(s)
+	if err != nil {
+		return errors.New("Invalid minimum response size for " + productId + ": " + err.Error())
+	}
+	if res.ContentLength < min {
+		return errors.New("Response too small: got " + strconv.FormatInt(res.ContentLength, 10) + " bytes, need at least " + strconv.FormatInt(min, 10))
+	}
+	return nil
+}
+
+func checkAllowedType(md *mmdbMetadata) error {
+	allowed := splitList(*allowedTypes)
+	if len(allowed) == 0 {
+		return nil
+	}
+	if md == nil {
+		return errors.New("Not a MaxMind DB, but --allowed-types is set")
+	}
+	for _, t := range allowed {
+		if md.DatabaseType == t {
+			return nil
+		}
+	}
+	return errors.New("Database type " + md.DatabaseType + " is not in --allowed-types")
+}
+
+func verifyDatabase(data []byte) error {
+	md, err := metadataFromBytes(data)
+	if err != nil {
+		return checkAllowedType(nil)
+	}
+	if err := checkAllowedType(md); err != nil {
+		return err
+	}
+	r, err := openMMDB(data)
+	if err != nil {
+		return err
+	}
+	ips, err := verifyAddresses()
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if _, _, err := r.lookup(ip); err != nil {
+			return errors.New("Lookup of " + ip.String() + " failed: " + err.Error())
+		}
+	}
+	return checkExpectations(md, r)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func withExpectations(t *testing.T, exps ...string) {
+	old := *verifyExpect
+	*verifyExpect = exps
+	t.Cleanup(func() { *verifyExpect = old })
+}
+
+func TestVerifyExpectCountryAS(t *testing.T) {
+	db := testMMDBWith("GeoLite2-Country", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "AS"},
+	})
+	withExpectations(t, "1.1.1.1=AS")
+	if err := verifyDatabase(db); err != nil {
+		t.Fatalf("American Samoa rejected: %v", err)
+	}
+	withExpectations(t, "1.1.1.1=as")
+	if err := verifyDatabase(db); err != nil {
+		t.Fatalf("lower case country code rejected: %v", err)
+	}
+	withExpectations(t, "1.1.1.1=AU")
+	if err := verifyDatabase(db); err == nil || !strings.Contains(err.Error(), "got 'AS'") {
+		t.Fatalf("err = %v, want a mismatch", err)
+	}
+}
+
+func TestVerifyExpectASN(t *testing.T) {
+	db := testMMDBWith("GeoLite2-ASN", map[string]interface{}{
+		"autonomous_system_number": uint64(13335),
+	})
+	for _, want := range []string{"13335", "AS13335", "as13335"} {
+		withExpectations(t, "1.1.1.1="+want)
+		if err := verifyDatabase(db); err != nil {
+			t.Fatalf("%s rejected: %v", want, err)
+		}
+	}
+	withExpectations(t, "1.1.1.1=AS15169")
+	if err := verifyDatabase(db); err == nil {
+		t.Fatal("wrong ASN accepted")
+	}
+}